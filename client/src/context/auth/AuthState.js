@@ -56,7 +56,7 @@ const AuthState = (props) => {
     } catch (error) {
       dispatch({
         type: REGISTER_FAIL,
-        payload: error.response.data.msg,
+        payload: error.response.data.error.message,
       });
     }
   };
@@ -80,7 +80,7 @@ const AuthState = (props) => {
     } catch (error) {
       dispatch({
         type: LOGIN_FAIL,
-        payload: error.response.data.msg,
+        payload: error.response.data.error.message,
       });
     }
   };
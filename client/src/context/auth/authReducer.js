@@ -21,7 +21,8 @@ export default (state, action) => {
       };
     case REGISTER_SUCCESS:
     case LOGIN_SUCCESS:
-      localStorage.setItem('token', action.payload);
+      localStorage.setItem('token', action.payload.token);
+      localStorage.setItem('refreshToken', action.payload.refresh_token);
       return {
         ...state,
         ...action.payload,
@@ -33,6 +34,7 @@ export default (state, action) => {
     case AUTH_ERROR:
     case LOGOUT:
       localStorage.removeItem('token');
+      localStorage.removeItem('refreshToken');
       return {
         ...state,
         token: null,
@@ -1,17 +1,45 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"os"
+	"io/ioutil"
+	"net/url"
+	"sockets/models"
+	"sockets/token"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// PostgresConfig describes how to reach Postgres. Either fill
+// in the individual settings or set DSN to a complete key=value
+// connection string or postgres:// URL, in which case only the
+// pool settings are used alongside it.
 type PostgresConfig struct {
 	Host     string `json:"host"`
 	Port     int    `json:"port"`
 	User     string `json:"user"`
 	Password string `json:"password"`
 	Name     string `json:"name"`
+	// SSLMode is passed to lib/pq as is. Production requires
+	// one of require, verify-ca or verify-full.
+	SSLMode     string `json:"sslmode"`
+	SSLRootCert string `json:"sslrootcert"`
+	SSLCert     string `json:"sslcert"`
+	SSLKey      string `json:"sslkey"`
+	// ConnectTimeout is in seconds and StatementTimeout in
+	// milliseconds. Zero leaves the driver or server default.
+	ConnectTimeout   int    `json:"connect_timeout"`
+	StatementTimeout int    `json:"statement_timeout"`
+	ApplicationName  string `json:"application_name"`
+	DSN              string `json:"dsn"`
+
+	// MaxOpenConns and MaxIdleConns size the connection pool,
+	// and ConnMaxLifetime is in seconds. Zero leaves the
+	// database/sql default.
+	MaxOpenConns    int `json:"max_open_conns"`
+	MaxIdleConns    int `json:"max_idle_conns"`
+	ConnMaxLifetime int `json:"conn_max_lifetime"`
 }
 
 func (c PostgresConfig) Dialect() string {
@@ -19,59 +47,283 @@ func (c PostgresConfig) Dialect() string {
 }
 
 func (c PostgresConfig) ConnectionInfo() string {
-	if c.Password == "" {
-		return fmt.Sprintf("host=%s port=%d user=%s dbname=%s sslmode=disable", c.Host, c.Port, c.User, c.Name)
+	if c.DSN != "" {
+		return c.DSN
+	}
+	sslMode := c.SSLMode
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+	params := []struct {
+		key, value string
+	}{
+		{"host", c.Host},
+		{"port", strconv.Itoa(c.Port)},
+		{"user", c.User},
+		{"password", c.Password},
+		{"dbname", c.Name},
+		{"sslmode", sslMode},
+		{"sslrootcert", c.SSLRootCert},
+		{"sslcert", c.SSLCert},
+		{"sslkey", c.SSLKey},
+		{"application_name", c.ApplicationName},
+	}
+	if c.ConnectTimeout > 0 {
+		params = append(params, struct{ key, value string }{"connect_timeout", strconv.Itoa(c.ConnectTimeout)})
+	}
+	if c.StatementTimeout > 0 {
+		params = append(params, struct{ key, value string }{"statement_timeout", strconv.Itoa(c.StatementTimeout)})
+	}
+	var parts []string
+	for _, p := range params {
+		if p.value == "" {
+			continue
+		}
+		parts = append(parts, p.key+"="+quoteConnValue(p.value))
+	}
+	return strings.Join(parts, " ")
+}
+
+// EffectiveSSLMode is the sslmode the driver will end up using,
+// including when it comes from DSN. lib/pq defaults to require
+// when a connection string leaves it out.
+func (c PostgresConfig) EffectiveSSLMode() string {
+	if c.DSN == "" {
+		return c.SSLMode
+	}
+	if u, err := url.Parse(c.DSN); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		if mode := u.Query().Get("sslmode"); mode != "" {
+			return mode
+		}
+		return "require"
+	}
+	for _, field := range strings.Fields(c.DSN) {
+		if strings.HasPrefix(field, "sslmode=") {
+			return strings.Trim(strings.TrimPrefix(field, "sslmode="), "'")
+		}
+	}
+	return "require"
+}
+
+func (c PostgresConfig) Pool() models.ConnPool {
+	return models.ConnPool{
+		MaxOpenConns:    c.MaxOpenConns,
+		MaxIdleConns:    c.MaxIdleConns,
+		ConnMaxLifetime: time.Duration(c.ConnMaxLifetime) * time.Second,
 	}
-	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", c.Host, c.Port, c.User, c.Password, c.Name)
+}
+
+// quoteConnValue quotes a value for a key=value connection
+// string. Values with spaces, quotes or backslashes (a common
+// sight in generated passwords) are wrapped in single quotes
+// with the quotes and backslashes escaped.
+func quoteConnValue(value string) string {
+	if !strings.ContainsAny(value, " \t\n'\\") {
+		return value
+	}
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `'`, `\'`, -1)
+	return "'" + value + "'"
 }
 
 func DefaultPostgresConfig() PostgresConfig {
 	return PostgresConfig{
-		Host:     "localhost",
-		Port:     5432,
-		User:     "ian",
-		Password: "password",
-		Name:     "chat_db",
+		Host:            "localhost",
+		Port:            5432,
+		User:            "ian",
+		Password:        "password",
+		Name:            "chat_db",
+		SSLMode:         "disable",
+		ConnectTimeout:  10,
+		ApplicationName: "sockets",
+		MaxOpenConns:    20,
+		MaxIdleConns:    5,
+		ConnMaxLifetime: 30 * 60,
 	}
 }
 
-type Config struct {
-	Port      int            `json:"port"`
-	Env       string         `json:"env"`
-	Pepper    string         `json:"pepper"`
-	Database  PostgresConfig `json:"database"`
-	JWTSecret string         `json:"jwt_secret"`
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+	// SQLiteMemory as the SQLitePath keeps the whole database in
+	// memory. It is gone once the process exits.
+	SQLiteMemory = ":memory:"
+)
+
+// DatabaseConfig picks the storage backend. Postgres is the
+// default and is configured through the embedded
+// PostgresConfig, so its settings sit directly under
+// "database" as they always have. SQLite, on disk or in
+// memory, is for local development and tests.
+type DatabaseConfig struct {
+	Driver     string `json:"driver"`
+	SQLitePath string `json:"sqlite_path"`
+	PostgresConfig
 }
 
-func (c Config) IsProd() bool {
-	return c.Env == "prod"
+func (c DatabaseConfig) IsSQLite() bool {
+	return c.Driver == DriverSQLite
 }
 
-func DefaultConfig() Config {
-	return Config{
-		Port:      5000,
-		Env:       "dev",
-		Pepper:    "secret-random-string",
-		JWTSecret: "silly-string",
-		Database:  DefaultPostgresConfig(),
+func (c DatabaseConfig) Dialect() string {
+	if c.IsSQLite() {
+		return "sqlite3"
+	}
+	return c.PostgresConfig.Dialect()
+}
+
+func (c DatabaseConfig) ConnectionInfo() string {
+	if c.IsSQLite() {
+		// SQLite ignores foreign keys unless asked to.
+		sep := "?"
+		if strings.Contains(c.SQLitePath, "?") {
+			sep = "&"
+		}
+		return c.SQLitePath + sep + "_foreign_keys=1"
+	}
+	return c.PostgresConfig.ConnectionInfo()
+}
+
+// Pool uses a single connection for SQLite. Writers lock the
+// whole file anyway, and every new connection to ":memory:"
+// would open a new, empty database.
+func (c DatabaseConfig) Pool() models.ConnPool {
+	if c.IsSQLite() {
+		return models.ConnPool{MaxOpenConns: 1, MaxIdleConns: 1}
 	}
+	return c.PostgresConfig.Pool()
 }
 
-func LoadConfig(configReq bool) Config {
-	f, err := os.Open(".config")
-	if err != nil {
-		if configReq {
-			panic(err)
+func DefaultDatabaseConfig() DatabaseConfig {
+	return DatabaseConfig{
+		Driver:         DriverPostgres,
+		PostgresConfig: DefaultPostgresConfig(),
+	}
+}
+
+// JWTKeyConfig describes one access token signing key.
+// HS256 keys take a Secret. RS256 and EdDSA keys take a
+// PrivateKeyFile, or only a PublicKeyFile for a retired key
+// that should still verify tokens but not sign new ones.
+type JWTKeyConfig struct {
+	ID             string `json:"id"`
+	Algorithm      string `json:"algorithm"`
+	Secret         string `json:"secret"`
+	PrivateKeyFile string `json:"private_key_file"`
+	PublicKeyFile  string `json:"public_key_file"`
+}
+
+func (c JWTKeyConfig) Key() (*token.Key, error) {
+	switch {
+	case c.Algorithm == token.AlgHS256:
+		return token.NewHMACKey(c.ID, []byte(c.Secret)), nil
+	case c.PrivateKeyFile != "":
+		pem, err := ioutil.ReadFile(c.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		switch c.Algorithm {
+		case token.AlgRS256:
+			return token.NewRSAKey(c.ID, pem)
+		case token.AlgEdDSA:
+			return token.NewEdDSAKey(c.ID, pem)
 		}
-		fmt.Println("Using the default config...")
-		return DefaultConfig()
+	case c.PublicKeyFile != "":
+		pem, err := ioutil.ReadFile(c.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return token.NewPublicKey(c.ID, c.Algorithm, pem)
 	}
-	var c Config
-	dec := json.NewDecoder(f)
-	err = dec.Decode(&c)
-	if err != nil {
-		panic(err)
+	return nil, fmt.Errorf("jwt key %q: unsupported algorithm %q or missing key file", c.ID, c.Algorithm)
+}
+
+// JWTConfig lists every key access tokens may be signed with.
+// New tokens are signed with ActiveKey; the others are only
+// used to verify tokens they signed before a rotation.
+type JWTConfig struct {
+	Issuer    string         `json:"issuer"`
+	Audience  string         `json:"audience"`
+	ActiveKey string         `json:"active_key"`
+	Keys      []JWTKeyConfig `json:"keys"`
+}
+
+func DefaultJWTConfig() JWTConfig {
+	return JWTConfig{
+		Issuer:   "sockets",
+		Audience: "sockets",
+	}
+}
+
+type Config struct {
+	Port int    `json:"port"`
+	Env  string `json:"env"`
+	// ShutdownTimeout is how many seconds in-flight requests and
+	// socket connections get to finish once the server is told
+	// to stop.
+	ShutdownTimeout int `json:"shutdown_timeout"`
+	// AutoMigrate applies pending schema migrations at startup.
+	// Turn it off in production to run "migrate up" as a
+	// separate deploy step instead.
+	AutoMigrate bool `json:"auto_migrate"`
+	// MessageEditWindow is how many seconds after sending a
+	// message its sender may still edit or delete it. Zero
+	// means there is no limit.
+	MessageEditWindow int            `json:"message_edit_window"`
+	Pepper            string         `json:"pepper"`
+	Database          DatabaseConfig `json:"database"`
+	// JWTSecret is used as an HS256 key with the ID "default"
+	// when JWT.Keys is empty.
+	JWTSecret string    `json:"jwt_secret"`
+	JWT       JWTConfig `json:"jwt"`
+}
+
+// TokenIssuer builds the access token issuer from the JWT
+// section, falling back to JWTSecret for older configs.
+func (c Config) TokenIssuer() (*token.Issuer, error) {
+	keyCfgs := c.JWT.Keys
+	active := c.JWT.ActiveKey
+	if len(keyCfgs) == 0 {
+		keyCfgs = []JWTKeyConfig{{
+			ID:        "default",
+			Algorithm: token.AlgHS256,
+			Secret:    c.JWTSecret,
+		}}
+		active = "default"
+	}
+	keys := make([]*token.Key, len(keyCfgs))
+	for i, kc := range keyCfgs {
+		key, err := kc.Key()
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+	}
+	return token.NewIssuer(c.JWT.Issuer, c.JWT.Audience, active, keys...)
+}
+
+func (c Config) IsProd() bool {
+	return c.Env == "prod"
+}
+
+func (c Config) ShutdownDeadline() time.Duration {
+	return time.Duration(c.ShutdownTimeout) * time.Second
+}
+
+func (c Config) EditWindow() time.Duration {
+	return time.Duration(c.MessageEditWindow) * time.Second
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Port:              5000,
+		Env:               "dev",
+		ShutdownTimeout:   15,
+		AutoMigrate:       true,
+		MessageEditWindow: 15 * 60,
+		Pepper:            "secret-random-string",
+		JWTSecret:         "silly-string",
+		JWT:               DefaultJWTConfig(),
+		Database:          DefaultDatabaseConfig(),
 	}
-	fmt.Println("Successfully loaded .config")
-	return c
 }
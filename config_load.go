@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix starts the name of every environment variable that
+// overrides a config setting. The rest of the name is the
+// setting's JSON path upper cased with dots turned into
+// underscores, so database.host is SOCKETS_DATABASE_HOST.
+const EnvPrefix = "SOCKETS_"
+
+// ConfigSources records where the value of every setting came
+// from, keyed by the setting's JSON path (e.g. "database.host").
+// Sources are "default", "file <path>", "env <NAME>" or
+// "flag -<name>".
+type ConfigSources map[string]string
+
+// Overridden lists the settings that don't have their default
+// value source, sorted by path.
+func (s ConfigSources) Overridden() []string {
+	var lines []string
+	for path, src := range s {
+		if src != "default" {
+			lines = append(lines, fmt.Sprintf("%s (%s)", path, src))
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// ConfigError lists every setting that could not be loaded,
+// along with where its bad value came from.
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return "config:\n  " + strings.Join(e, "\n  ")
+}
+
+// FlagOverride is a command line flag that was set to override
+// the config setting at Path.
+type FlagOverride struct {
+	Path  string
+	Flag  string
+	Value string
+}
+
+// LoadConfig builds the Config in increasing order of
+// precedence:
+//
+//	defaults < config file at path < SOCKETS_* env vars < flags
+//
+// A missing config file is only an error if required is set.
+// Every problem found is reported at once in a ConfigError,
+// along with where the offending value came from.
+func LoadConfig(path string, required bool, flags []FlagOverride) (Config, ConfigSources, error) {
+	c := DefaultConfig()
+	sources := ConfigSources{}
+	var errs ConfigError
+
+	fields := configFields(reflect.ValueOf(&c).Elem(), "")
+	for _, f := range fields {
+		sources[f.path] = "default"
+	}
+
+	if err := loadConfigFile(path, required, &c, sources); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	for _, f := range fields {
+		name := f.envName()
+		raw, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		src := "env " + name
+		if err := f.set(raw); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: invalid value from %s: %v", f.path, src, err))
+			continue
+		}
+		sources[f.path] = src
+	}
+
+	byPath := make(map[string]configField, len(fields))
+	for _, f := range fields {
+		byPath[f.path] = f
+	}
+	for _, fo := range flags {
+		f, ok := byPath[fo.Path]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("flag -%s: unknown setting %s", fo.Flag, fo.Path))
+			continue
+		}
+		src := "flag -" + fo.Flag
+		if err := f.set(fo.Value); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: invalid value from %s: %v", f.path, src, err))
+			continue
+		}
+		sources[f.path] = src
+	}
+
+	if len(errs) > 0 {
+		return c, sources, errs
+	}
+	return c, sources, nil
+}
+
+// loadConfigFile decodes the JSON file at path over c and marks
+// every setting the file mentions as coming from it.
+func loadConfigFile(path string, required bool, c *Config, sources ConfigSources) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("config file: %v", err)
+	}
+	if err := json.Unmarshal(b, c); err != nil {
+		return fmt.Errorf("config file %s: %v", path, err)
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return fmt.Errorf("config file %s: %v", path, err)
+	}
+	markFileSources(raw, "", "file "+path, sources)
+	return nil
+}
+
+func markFileSources(raw map[string]interface{}, prefix, src string, sources ConfigSources) {
+	for key, v := range raw {
+		path := prefix + key
+		if nested, ok := v.(map[string]interface{}); ok {
+			markFileSources(nested, path+".", src, sources)
+			continue
+		}
+		if _, known := sources[path]; known {
+			sources[path] = src
+		}
+	}
+}
+
+// configField is a single setting in Config.
+type configField struct {
+	path  string
+	value reflect.Value
+}
+
+func (f configField) envName() string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(f.path, ".", "_", -1))
+}
+
+// set parses raw into the field. Strings, numbers and bools are
+// parsed as is; anything else, such as a list of keys, is
+// expected to be JSON.
+func (f configField) set(raw string) error {
+	v := f.value
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(raw, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(raw, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	default:
+		ptr := reflect.New(v.Type())
+		if err := json.Unmarshal([]byte(raw), ptr.Interface()); err != nil {
+			return err
+		}
+		v.Set(ptr.Elem())
+	}
+	return nil
+}
+
+// configFields lists every setting in the struct v, recursing
+// into nested structs. Embedded structs share their parent's
+// prefix, the same as in encoding/json.
+func configFields(v reflect.Value, prefix string) []configField {
+	var fields []configField
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		fv := v.Field(i)
+		if sf.Anonymous && fv.Kind() == reflect.Struct {
+			fields = append(fields, configFields(fv, prefix)...)
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		if fv.Kind() == reflect.Struct {
+			fields = append(fields, configFields(fv, prefix+name+".")...)
+			continue
+		}
+		fields = append(fields, configField{path: prefix + name, value: fv})
+	}
+	return fields
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setenv sets an environment variable for the rest of the
+// test.
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Unsetenv(key) })
+}
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, ".config")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"port": 4000,
+		"database": {"host": "file-host", "port": 6543, "driver": "sqlite"},
+		"jwt": {"issuer": "file-issuer", "audience": "file-audience"}
+	}`)
+	setenv(t, "SOCKETS_PORT", "5000")
+	setenv(t, "SOCKETS_DATABASE_HOST", "env-host")
+	setenv(t, "SOCKETS_JWT_AUDIENCE", "env-audience")
+	setenv(t, "SOCKETS_JWT_KEYS", `[{"id":"k1","algorithm":"HS256","secret":"s"}]`)
+	flags := []FlagOverride{
+		{Path: "port", Flag: "port", Value: "6000"},
+		{Path: "database.driver", Flag: "db-driver", Value: "postgres"},
+	}
+
+	c, sources, err := LoadConfig(path, true, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileSrc := "file " + path
+	tests := []struct {
+		path    string
+		got     interface{}
+		want    interface{}
+		wantSrc string
+	}{
+		{"port", c.Port, 6000, "flag -port"},
+		{"database.driver", c.Database.Driver, "postgres", "flag -db-driver"},
+		{"database.host", c.Database.Host, "env-host", "env SOCKETS_DATABASE_HOST"},
+		{"database.port", c.Database.Port, 6543, fileSrc},
+		{"database.name", c.Database.Name, DefaultPostgresConfig().Name, "default"},
+		{"jwt.issuer", c.JWT.Issuer, "file-issuer", fileSrc},
+		{"jwt.audience", c.JWT.Audience, "env-audience", "env SOCKETS_JWT_AUDIENCE"},
+		{"env", c.Env, DefaultConfig().Env, "default"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.path, tt.got, tt.want)
+		}
+		if sources[tt.path] != tt.wantSrc {
+			t.Errorf("%s source = %q, want %q", tt.path, sources[tt.path], tt.wantSrc)
+		}
+	}
+	if len(c.JWT.Keys) != 1 || c.JWT.Keys[0].ID != "k1" || c.JWT.Keys[0].Secret != "s" {
+		t.Errorf("jwt.keys = %+v, want the key from SOCKETS_JWT_KEYS", c.JWT.Keys)
+	}
+}
+
+func TestLoadConfigBadValues(t *testing.T) {
+	setenv(t, "SOCKETS_PORT", "eighty")
+	setenv(t, "SOCKETS_AUTO_MIGRATE", "maybe")
+	setenv(t, "SOCKETS_JWT_KEYS", "not json")
+	setenv(t, "SOCKETS_DATABASE_HOST", "env-host")
+	flags := []FlagOverride{
+		{Path: "database.port", Flag: "db-port", Value: "-"},
+		{Path: "no.such.setting", Flag: "nope", Value: "1"},
+	}
+
+	c, _, err := LoadConfig(filepath.Join(os.TempDir(), "no-such-config"), false, flags)
+	errs, ok := err.(ConfigError)
+	if !ok {
+		t.Fatalf("err = %v, want a ConfigError", err)
+	}
+	want := []string{
+		"port: invalid value from env SOCKETS_PORT",
+		"auto_migrate: invalid value from env SOCKETS_AUTO_MIGRATE",
+		"jwt.keys: invalid value from env SOCKETS_JWT_KEYS",
+		"database.port: invalid value from flag -db-port",
+		"flag -nope: unknown setting no.such.setting",
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("got %d errors, want %d:\n%v", len(errs), len(want), err)
+	}
+	for _, w := range want {
+		if !strings.Contains(err.Error(), w) {
+			t.Errorf("error does not mention %q:\n%v", w, err)
+		}
+	}
+	// Good values are still applied alongside the bad ones.
+	if c.Database.Host != "env-host" {
+		t.Errorf("database.host = %q, want env-host", c.Database.Host)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	missing := filepath.Join(os.TempDir(), "no-such-config")
+	if _, _, err := LoadConfig(missing, false, nil); err != nil {
+		t.Errorf("optional missing file: err = %v, want nil", err)
+	}
+	if _, _, err := LoadConfig(missing, true, nil); err == nil {
+		t.Error("required missing file: err = nil, want an error")
+	}
+	bad := writeConfigFile(t, `{"port": "eighty"}`)
+	if _, _, err := LoadConfig(bad, true, nil); err == nil || !strings.Contains(err.Error(), bad) {
+		t.Errorf("bad file: err = %v, want an error naming %s", err, bad)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"sockets/token"
+)
+
+const (
+	// minPepperLength and minJWTSecretLength are the shortest
+	// secrets we accept in production.
+	minPepperLength    = 16
+	minJWTSecretLength = 32
+)
+
+// ConfigProblem is one thing wrong with a Config. Path is the
+// JSON path of the setting at fault.
+type ConfigProblem struct {
+	Path    string
+	Message string
+	// Insecure problems are tolerated in development, where
+	// the defaults are meant to just work, but stop the server
+	// from starting in production. Every other problem always
+	// stops it.
+	Insecure bool
+}
+
+type configProblems []ConfigProblem
+
+func (p *configProblems) fatal(path, format string, args ...interface{}) {
+	*p = append(*p, ConfigProblem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (p *configProblems) insecure(path, format string, args ...interface{}) {
+	*p = append(*p, ConfigProblem{Path: path, Message: fmt.Sprintf(format, args...), Insecure: true})
+}
+
+// Validate returns every problem with c at once rather than
+// stopping at the first, so a broken deploy can be fixed in one
+// go.
+func (c Config) Validate() []ConfigProblem {
+	defaults := DefaultConfig()
+	var problems configProblems
+	fatal, insecure := problems.fatal, problems.insecure
+	secret := func(path, value, def string, minLength int) {
+		switch {
+		case value == "":
+			insecure(path, "is empty")
+		case value == def:
+			insecure(path, "is the built-in default")
+		case len(value) < minLength:
+			insecure(path, "is shorter than %d characters", minLength)
+		}
+	}
+
+	if c.Port < 1 || c.Port > 65535 {
+		fatal("port", "must be between 1 and 65535, got %d", c.Port)
+	}
+	if c.Env != "dev" && c.Env != "prod" {
+		fatal("env", "must be dev or prod, got %q", c.Env)
+	}
+	if c.ShutdownTimeout <= 0 {
+		fatal("shutdown_timeout", "must be a positive number of seconds, got %d", c.ShutdownTimeout)
+	}
+	if c.MessageEditWindow < 0 {
+		fatal("message_edit_window", "must be zero or a positive number of seconds, got %d", c.MessageEditWindow)
+	}
+	secret("pepper", c.Pepper, defaults.Pepper, minPepperLength)
+
+	if len(c.JWT.Keys) == 0 {
+		secret("jwt_secret", c.JWTSecret, defaults.JWTSecret, minJWTSecretLength)
+	} else {
+		active := false
+		for _, k := range c.JWT.Keys {
+			if k.ID == c.JWT.ActiveKey {
+				active = true
+			}
+			switch k.Algorithm {
+			case token.AlgHS256:
+				secret("jwt.keys", k.Secret, defaults.JWTSecret, minJWTSecretLength)
+			case token.AlgRS256, token.AlgEdDSA:
+				if k.PrivateKeyFile == "" && k.PublicKeyFile == "" {
+					fatal("jwt.keys", "key %q needs a private_key_file or public_key_file", k.ID)
+				}
+			default:
+				fatal("jwt.keys", "key %q has unknown algorithm %q", k.ID, k.Algorithm)
+			}
+		}
+		if !active {
+			fatal("jwt.active_key", "%q is not one of jwt.keys", c.JWT.ActiveKey)
+		}
+	}
+	if c.JWT.Issuer == "" {
+		fatal("jwt.issuer", "is required")
+	}
+	if c.JWT.Audience == "" {
+		fatal("jwt.audience", "is required")
+	}
+
+	db := c.Database
+	switch db.Driver {
+	case DriverPostgres:
+		db.PostgresConfig.validate(&problems, defaults.Database.PostgresConfig)
+	case DriverSQLite:
+		if db.SQLitePath == "" {
+			fatal("database.sqlite_path", "is required for the sqlite driver; use %q for an in-memory database", SQLiteMemory)
+		}
+		insecure("database.driver", "sqlite is only meant for development and tests")
+	default:
+		fatal("database.driver", "must be %s or %s, got %q", DriverPostgres, DriverSQLite, db.Driver)
+	}
+	return problems
+}
+
+// validate adds any problems with the Postgres settings to
+// problems. defaults is used to spot values nobody changed.
+func (db PostgresConfig) validate(problems *configProblems, defaults PostgresConfig) {
+	fatal, insecure := problems.fatal, problems.insecure
+	if db.DSN == "" {
+		if db.Host == "" {
+			fatal("database.host", "is required")
+		}
+		if db.Port < 1 || db.Port > 65535 {
+			fatal("database.port", "must be between 1 and 65535, got %d", db.Port)
+		}
+		if db.User == "" {
+			fatal("database.user", "is required")
+		}
+		if db.Name == "" {
+			fatal("database.name", "is required")
+		}
+		if db.Password == defaults.Password {
+			insecure("database.password", "is the built-in default")
+		}
+	}
+	sslPath := "database.sslmode"
+	if db.DSN != "" {
+		sslPath = "database.dsn"
+	}
+	switch mode := db.EffectiveSSLMode(); mode {
+	case "require", "verify-ca", "verify-full":
+	case "", "disable", "allow", "prefer":
+		insecure(sslPath, "sslmode %q does not require TLS", mode)
+	default:
+		fatal(sslPath, "unknown sslmode %q", mode)
+	}
+	if (db.SSLCert == "") != (db.SSLKey == "") {
+		fatal("database.sslcert", "and database.sslkey must be set together")
+	}
+	for _, setting := range []struct {
+		path  string
+		value int
+	}{
+		{"database.connect_timeout", db.ConnectTimeout},
+		{"database.statement_timeout", db.StatementTimeout},
+		{"database.max_open_conns", db.MaxOpenConns},
+		{"database.max_idle_conns", db.MaxIdleConns},
+		{"database.conn_max_lifetime", db.ConnMaxLifetime},
+	} {
+		if setting.value < 0 {
+			fatal(setting.path, "must not be negative, got %d", setting.value)
+		}
+	}
+	if db.MaxOpenConns > 0 && db.MaxIdleConns > db.MaxOpenConns {
+		fatal("database.max_idle_conns", "must not exceed database.max_open_conns (%d)", db.MaxOpenConns)
+	}
+}
+
+// CheckConfig validates c and decides what to do about it. In
+// production every problem is an error; in development the
+// insecure ones are returned as warnings instead. Each line
+// says where the offending value came from.
+func CheckConfig(c Config, sources ConfigSources, prod bool) (warnings []string, err error) {
+	var errs ConfigError
+	for _, p := range c.Validate() {
+		src, ok := sources[p.Path]
+		if !ok {
+			src = "default"
+		}
+		line := fmt.Sprintf("%s %s (from %s)", p.Path, p.Message, src)
+		if p.Insecure && !prod {
+			warnings = append(warnings, line)
+			continue
+		}
+		errs = append(errs, line)
+	}
+	if len(errs) > 0 {
+		return warnings, errs
+	}
+	return warnings, nil
+}
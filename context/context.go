@@ -6,9 +6,53 @@ import (
 )
 
 const (
-	userKey privateKey = "user"
+	userKey      privateKey = "user"
+	tokenKey     privateKey = "token_state"
+	tokenIDKey   privateKey = "token_id"
+	requestIDKey privateKey = "request_id"
 )
 
+// TokenState records what the User middleware made of the
+// credentials on a request, so that later handlers can tell an
+// anonymous request apart from one with a bad token.
+type TokenState int
+
+const (
+	// TokenMissing means no token was sent at all.
+	TokenMissing TokenState = iota
+	// TokenValid means the token checked out and the user was
+	// found.
+	TokenValid
+	// TokenMalformed means the token could not be decoded.
+	TokenMalformed
+	// TokenExpired means the token was well formed and signed
+	// by us, but is past its expiry.
+	TokenExpired
+	// TokenRevoked means the token was valid but the session it
+	// belongs to has been logged out.
+	TokenRevoked
+	// TokenInvalid covers every other failure, such as a bad
+	// signature or a user that no longer exists.
+	TokenInvalid
+)
+
+func (s TokenState) String() string {
+	switch s {
+	case TokenMissing:
+		return "missing"
+	case TokenValid:
+		return "valid"
+	case TokenMalformed:
+		return "malformed"
+	case TokenExpired:
+		return "expired"
+	case TokenRevoked:
+		return "revoked"
+	default:
+		return "invalid"
+	}
+}
+
 type privateKey string
 
 func WithUser(ctx context.Context, user *models.User) context.Context {
@@ -23,3 +67,40 @@ func User(ctx context.Context) *models.User {
 	}
 	return nil
 }
+
+func WithTokenState(ctx context.Context, state TokenState) context.Context {
+	return context.WithValue(ctx, tokenKey, state)
+}
+
+// Token returns TokenMissing if the User middleware has not
+// run on this request.
+func Token(ctx context.Context) TokenState {
+	if state, ok := ctx.Value(tokenKey).(TokenState); ok {
+		return state
+	}
+	return TokenMissing
+}
+
+// WithTokenID stores the jti claim of the access token that
+// authenticated the request.
+func WithTokenID(ctx context.Context, jti string) context.Context {
+	return context.WithValue(ctx, tokenIDKey, jti)
+}
+
+func TokenID(ctx context.Context) string {
+	if jti, ok := ctx.Value(tokenIDKey).(string); ok {
+		return jti
+	}
+	return ""
+}
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+func RequestID(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDKey).(string); ok {
+		return id
+	}
+	return ""
+}
@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"net/http"
+	"sockets/context"
+	"sockets/models"
+	"sockets/views"
+)
+
+type Blocks struct {
+	fs models.FriendService
+	us models.UserService
+}
+
+func NewBlocks(fs models.FriendService, us models.UserService) *Blocks {
+	return &Blocks{
+		fs: fs,
+		us: us,
+	}
+}
+
+// Index lists the users the current user has blocked, newest
+// first, in the same shape and with the same paging as the
+// friends list.
+//
+// GET /api/blocks
+func (b *Blocks) Index(w http.ResponseWriter, r *http.Request) {
+	list, ok := findFriends(w, r, b.fs, b.us, models.FriendQuery{
+		Direction: models.FriendOutgoing,
+		Status:    models.FriendBlocked,
+	})
+	if ok {
+		views.RenderJSON(w, http.StatusOK, list)
+	}
+}
+
+// Create blocks a user, severing any relationship the current
+// user had with them.
+//
+// POST /api/blocks/{userID}
+func (b *Blocks) Create(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	targetID, err := parseID(r, "userID")
+	if err != nil {
+		views.RenderStatus(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	block, err := b.fs.Block(user.ID, targetID)
+	if err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	renderFriend(w, r, b.us, http.StatusCreated, user.ID, block)
+}
+
+// Delete lifts a block.
+//
+// DELETE /api/blocks/{userID}
+func (b *Blocks) Delete(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	targetID, err := parseID(r, "userID")
+	if err != nil {
+		views.RenderStatus(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	if err := b.fs.Unblock(user.ID, targetID); err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -2,35 +2,100 @@ package controllers
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"sockets/context"
 	"sockets/models"
+	"sockets/views"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
 type Friends struct {
 	fs models.FriendService
+	us models.UserService
+	ms models.MessageService
 	r  *mux.Router
 }
 
-func NewFriends(fs models.FriendService, r *mux.Router) *Friends {
+// FriendResponse is one relationship as the current user sees
+// it: User is whoever is on the other side, and Direction says
+// whether the current user sent (outgoing) or received
+// (incoming) the request.
+type FriendResponse struct {
+	ID        uint                   `json:"id"`
+	Status    models.FriendStatus    `json:"status"`
+	Direction models.FriendDirection `json:"direction"`
+	User      PublicUser             `json:"user"`
+	CreatedAt time.Time              `json:"created_at"`
+	UpdatedAt time.Time              `json:"updated_at"`
+	// UnreadCount is how many messages from User the current
+	// user hasn't read. It is only filled in on the friends
+	// list.
+	UnreadCount int `json:"unread_count"`
+}
+
+// FriendList is a page of FriendResponses. Pass NextCursor
+// back as ?cursor= to get the next page; it is left out on the
+// last one.
+type FriendList struct {
+	Friends    []FriendResponse `json:"friends"`
+	NextCursor uint             `json:"next_cursor,omitempty"`
+	// UnreadTotal counts every unread direct message, not
+	// just those from the friends on this page.
+	UnreadTotal int `json:"unread_total"`
+}
+
+// FriendForm is what the add friend modal posts. Its Name
+// field holds whatever was typed, an email address or handle.
+type FriendForm struct {
+	Friend struct {
+		Email  string `json:"email"`
+		Handle string `json:"handle"`
+		Name   string `json:"name"`
+	} `json:"friend"`
+}
+
+func NewFriends(fs models.FriendService, us models.UserService, ms models.MessageService, r *mux.Router) *Friends {
 	return &Friends{
 		fs: fs,
+		us: us,
+		ms: ms,
 		r:  r,
 	}
 }
 
-// GET /friends
+// Index lists the current user's relationships, newest first.
+// ?direction= is outgoing (the default, which is the friends
+// list once filtered to accepted) or incoming, ?status= is one
+// of the friend statuses, and ?cursor= and ?limit= page through
+// the results. Each friend comes with how many of their
+// messages are unread.
+//
+// GET /api/friends?status=pending&direction=incoming
 func (f *Friends) Index(w http.ResponseWriter, r *http.Request) {
 	user := context.User(r.Context())
-	friends, err := f.fs.ByUserID(user.ID)
+	query := r.URL.Query()
+	list, ok := findFriends(w, r, f.fs, f.us, models.FriendQuery{
+		Direction: models.FriendDirection(query.Get("direction")),
+		Status:    models.FriendStatus(query.Get("status")),
+	})
+	if !ok {
+		return
+	}
+	unread, err := f.ms.UnreadCounts(user.ID)
 	if err != nil {
-		panic(err)
+		views.RenderError(w, r, err)
+		return
 	}
-	fmt.Println(friends)
-	json.NewEncoder(w).Encode(friends)
+	for i := range list.Friends {
+		list.Friends[i].UnreadCount = unread[list.Friends[i].User.ID]
+	}
+	for _, n := range unread {
+		list.UnreadTotal += n
+	}
+	views.RenderJSON(w, http.StatusOK, list)
 }
 
 func (f *Friends) Show(w http.ResponseWriter, r *http.Request) {
@@ -43,15 +108,180 @@ func (f *Friends) Show(w http.ResponseWriter, r *http.Request) {
 	// g.ShowView.Render(w, r, vd)
 }
 
+// Create sends a friend request to the user with the given
+// email address or handle.
+//
+// POST /api/friends
 func (f *Friends) Create(w http.ResponseWriter, r *http.Request) {
 	user := context.User(r.Context())
-	var friend models.Friend
-	json.NewDecoder(r.Body).Decode(&friend)
-	friend.Status = "pending"
-	friend.UserID = user.ID
-	err := f.fs.Create(&friend)
+	var form FriendForm
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		views.RenderStatus(w, r, http.StatusBadRequest, "Invalid request body.")
+		return
+	}
+	query := form.Friend.Email
+	if query == "" {
+		query = form.Friend.Handle
+	}
+	if query == "" {
+		query = form.Friend.Name
+	}
+	friend, err := f.fs.Request(user.ID, query)
+	if err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	renderFriend(w, r, f.us, http.StatusCreated, user.ID, friend)
+}
+
+// Accept answers a pending request addressed to the current
+// user.
+//
+// POST /api/friends/{id}/accept
+func (f *Friends) Accept(w http.ResponseWriter, r *http.Request) {
+	f.respond(w, r, f.fs.Accept)
+}
+
+// Decline turns down a pending request addressed to the
+// current user.
+//
+// POST /api/friends/{id}/decline
+func (f *Friends) Decline(w http.ResponseWriter, r *http.Request) {
+	f.respond(w, r, f.fs.Decline)
+}
+
+// Delete unfriends, or cancels a request the current user
+// sent, on both sides of the relationship.
+//
+// DELETE /api/friends/{id}
+func (f *Friends) Delete(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := parseID(r, "id")
+	if err != nil {
+		views.RenderStatus(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	if err := f.fs.Unfriend(id, user.ID); err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// respond runs one of the FriendService answer methods against
+// the request in the URL and writes back the updated row.
+func (f *Friends) respond(w http.ResponseWriter, r *http.Request, answer func(id, userID uint) (*models.Friend, error)) {
+	user := context.User(r.Context())
+	id, err := parseID(r, "id")
 	if err != nil {
-		panic(err)
+		views.RenderStatus(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	friend, err := answer(id, user.ID)
+	if err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	renderFriend(w, r, f.us, http.StatusOK, user.ID, friend)
+}
+
+// findFriends looks up the page of the current user's rows
+// that fq and the ?cursor= and ?limit= parameters select. If
+// that fails it renders the error and returns false.
+func findFriends(w http.ResponseWriter, r *http.Request, fs models.FriendService, us models.UserService, fq models.FriendQuery) (*FriendList, bool) {
+	user := context.User(r.Context())
+	query := r.URL.Query()
+	fq.UserID = user.ID
+	if s := query.Get("cursor"); s != "" {
+		cursor, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			views.RenderStatus(w, r, http.StatusBadRequest, "Invalid cursor parameter.")
+			return nil, false
+		}
+		fq.Before = uint(cursor)
+	}
+	if s := query.Get("limit"); s != "" {
+		var err error
+		if fq.Limit, err = strconv.Atoi(s); err != nil {
+			views.RenderStatus(w, r, http.StatusBadRequest, "Invalid limit parameter.")
+			return nil, false
+		}
+	}
+	friends, err := fs.Find(fq)
+	if err != nil {
+		views.RenderError(w, r, err)
+		return nil, false
+	}
+	resp, err := newFriendResponses(us, user.ID, friends)
+	if err != nil {
+		views.RenderError(w, r, err)
+		return nil, false
+	}
+	list := FriendList{Friends: resp}
+	// A short page is the last one. A full one may be too, in
+	// which case the next page simply comes back empty.
+	if n := len(friends); n > 0 && n >= fq.PageSize() {
+		list.NextCursor = friends[n-1].ID
+	}
+	return &list, true
+}
+
+// renderFriend writes a single row as a FriendResponse.
+func renderFriend(w http.ResponseWriter, r *http.Request, us models.UserService, status int, userID uint, friend *models.Friend) {
+	resp, err := newFriendResponses(us, userID, []models.Friend{*friend})
+	if err == nil && len(resp) == 0 {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	views.RenderJSON(w, status, resp[0])
+}
+
+// newFriendResponses turns rows into what userID gets to see,
+// loading the users on the other side in one query.
+func newFriendResponses(us models.UserService, userID uint, friends []models.Friend) ([]FriendResponse, error) {
+	ids := make([]uint, len(friends))
+	for i, friend := range friends {
+		ids[i] = otherSide(userID, &friend)
+	}
+	users, err := us.ByIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]*models.User, len(users))
+	for i := range users {
+		byID[users[i].ID] = &users[i]
+	}
+	resp := make([]FriendResponse, 0, len(friends))
+	for _, friend := range friends {
+		other, ok := byID[otherSide(userID, &friend)]
+		if !ok {
+			// The other user has been deleted.
+			continue
+		}
+		direction := models.FriendOutgoing
+		if friend.UserID != userID {
+			direction = models.FriendIncoming
+		}
+		resp = append(resp, FriendResponse{
+			ID:        friend.ID,
+			Status:    friend.Status,
+			Direction: direction,
+			User:      newPublicUser(other),
+			CreatedAt: friend.CreatedAt,
+			UpdatedAt: friend.UpdatedAt,
+		})
+	}
+	return resp, nil
+}
+
+// otherSide returns the ID of the user on the other side of
+// friend from userID.
+func otherSide(userID uint, friend *models.Friend) uint {
+	if friend.UserID == userID {
+		return friend.FriendID
 	}
-	w.WriteHeader(http.StatusOK)
+	return friend.UserID
 }
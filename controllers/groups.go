@@ -0,0 +1,408 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sockets/context"
+	"sockets/models"
+	"sockets/views"
+	"time"
+)
+
+type Groups struct {
+	cs models.ConversationService
+	us models.UserService
+	ss models.SocketService
+}
+
+// GroupForm creates a group. MemberIDs are the friends to put
+// in it besides the current user.
+type GroupForm struct {
+	Name      string `json:"name"`
+	MemberIDs []uint `json:"member_ids"`
+}
+
+type GroupMembersForm struct {
+	UserIDs []uint `json:"user_ids"`
+}
+
+type GroupRoleForm struct {
+	Role models.ConversationRole `json:"role"`
+}
+
+type GroupOwnerForm struct {
+	UserID uint `json:"user_id"`
+}
+
+// GroupResponse is a group as one of its members sees it. Role
+// and Muted are that member's own.
+type GroupResponse struct {
+	ID        uint                    `json:"id"`
+	Name      string                  `json:"name"`
+	Role      models.ConversationRole `json:"role"`
+	Muted     bool                    `json:"muted"`
+	Members   []GroupMemberResponse   `json:"members"`
+	CreatedAt time.Time               `json:"created_at"`
+	UpdatedAt time.Time               `json:"updated_at"`
+}
+
+type GroupMemberResponse struct {
+	User     PublicUser              `json:"user"`
+	Role     models.ConversationRole `json:"role"`
+	JoinedAt time.Time               `json:"joined_at"`
+}
+
+// GroupRemoved is the data of the "group.removed" event sent
+// to someone who left or was taken out of a group.
+type GroupRemoved struct {
+	ID uint `json:"id"`
+}
+
+func NewGroups(cs models.ConversationService, us models.UserService, ss models.SocketService) *Groups {
+	return &Groups{
+		cs: cs,
+		us: us,
+		ss: ss,
+	}
+}
+
+// Index lists the groups the current user is in, newest
+// first.
+//
+// GET /api/groups
+func (g *Groups) Index(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	conversations, err := g.cs.ByUserID(user.ID)
+	if err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	resp := make([]GroupResponse, 0, len(conversations))
+	for i := range conversations {
+		group, err := g.load(&conversations[i], user.ID)
+		if err != nil {
+			views.RenderError(w, r, err)
+			return
+		}
+		resp = append(resp, *group)
+	}
+	views.RenderJSON(w, http.StatusOK, resp)
+}
+
+// Create starts a group with the current user as its owner.
+// Everyone else in it must be an accepted friend.
+//
+// POST /api/groups
+func (g *Groups) Create(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var form GroupForm
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		views.RenderStatus(w, r, http.StatusBadRequest, "Invalid request body.")
+		return
+	}
+	conversation, err := g.cs.Start(user.ID, form.Name, form.MemberIDs)
+	if err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	g.announce(conversation.ID)
+	g.render(w, r, http.StatusCreated, conversation.ID, user.ID)
+}
+
+// Show returns a group the current user is in.
+//
+// GET /api/groups/{id}
+func (g *Groups) Show(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := parseID(r, "id")
+	if err != nil {
+		views.RenderStatus(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	g.render(w, r, http.StatusOK, id, user.ID)
+}
+
+// Update renames a group. Only its owner and admins may.
+//
+// PATCH /api/groups/{id}
+func (g *Groups) Update(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := parseID(r, "id")
+	if err != nil {
+		views.RenderStatus(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	var form GroupForm
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		views.RenderStatus(w, r, http.StatusBadRequest, "Invalid request body.")
+		return
+	}
+	if _, err := g.cs.Rename(id, user.ID, form.Name); err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	g.announce(id)
+	g.render(w, r, http.StatusOK, id, user.ID)
+}
+
+// AddMembers adds friends of the current user to a group. Only
+// its owner and admins may.
+//
+// POST /api/groups/{id}/members
+func (g *Groups) AddMembers(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := parseID(r, "id")
+	if err != nil {
+		views.RenderStatus(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	var form GroupMembersForm
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		views.RenderStatus(w, r, http.StatusBadRequest, "Invalid request body.")
+		return
+	}
+	if _, err := g.cs.AddMembers(id, user.ID, form.UserIDs); err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	g.announce(id)
+	g.render(w, r, http.StatusOK, id, user.ID)
+}
+
+// UpdateMember makes a member an admin or takes that away.
+// Only the owner may.
+//
+// PATCH /api/groups/{id}/members/{userID}
+func (g *Groups) UpdateMember(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := parseID(r, "id")
+	if err != nil {
+		views.RenderStatus(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	memberID, err := parseID(r, "userID")
+	if err != nil {
+		views.RenderStatus(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	var form GroupRoleForm
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		views.RenderStatus(w, r, http.StatusBadRequest, "Invalid request body.")
+		return
+	}
+	if _, err := g.cs.SetRole(id, user.ID, memberID, form.Role); err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	g.announce(id)
+	g.render(w, r, http.StatusOK, id, user.ID)
+}
+
+// RemoveMember takes someone out of a group. Removing yourself
+// is the same as leaving.
+//
+// DELETE /api/groups/{id}/members/{userID}
+func (g *Groups) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := parseID(r, "id")
+	if err != nil {
+		views.RenderStatus(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	memberID, err := parseID(r, "userID")
+	if err != nil {
+		views.RenderStatus(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	if err := g.cs.RemoveMember(id, user.ID, memberID); err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	g.announce(id, memberID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Leave takes the current user out of a group. The owner has
+// to hand the group to someone else first unless they are the
+// last one in it.
+//
+// POST /api/groups/{id}/leave
+func (g *Groups) Leave(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := parseID(r, "id")
+	if err != nil {
+		views.RenderStatus(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	if err := g.cs.Leave(id, user.ID); err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	g.announce(id, user.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Transfer hands ownership of a group to another member. The
+// current owner stays on as an admin.
+//
+// POST /api/groups/{id}/owner
+func (g *Groups) Transfer(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := parseID(r, "id")
+	if err != nil {
+		views.RenderStatus(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	var form GroupOwnerForm
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		views.RenderStatus(w, r, http.StatusBadRequest, "Invalid request body.")
+		return
+	}
+	if err := g.cs.TransferOwnership(id, user.ID, form.UserID); err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	g.announce(id)
+	g.render(w, r, http.StatusOK, id, user.ID)
+}
+
+// Mute stops the current user being notified of new messages
+// in a group. They still receive them, and nobody else is
+// told.
+//
+// POST /api/groups/{id}/mute
+func (g *Groups) Mute(w http.ResponseWriter, r *http.Request) {
+	g.setMuted(w, r, true)
+}
+
+// Unmute undoes Mute.
+//
+// DELETE /api/groups/{id}/mute
+func (g *Groups) Unmute(w http.ResponseWriter, r *http.Request) {
+	g.setMuted(w, r, false)
+}
+
+func (g *Groups) setMuted(w http.ResponseWriter, r *http.Request, muted bool) {
+	user := context.User(r.Context())
+	id, err := parseID(r, "id")
+	if err != nil {
+		views.RenderStatus(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	if _, err := g.cs.SetMuted(id, user.ID, muted); err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	g.render(w, r, http.StatusOK, id, user.ID)
+}
+
+// render writes group id as viewerID sees it, or a 404 if they
+// are not in it.
+func (g *Groups) render(w http.ResponseWriter, r *http.Request, status int, id, viewerID uint) {
+	conversation, err := g.cs.ByID(id)
+	if err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	group, err := g.load(conversation, viewerID)
+	if err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	views.RenderJSON(w, status, group)
+}
+
+// load builds the response for conversation as viewerID sees
+// it. It returns ErrNotFound if viewerID is not a member.
+func (g *Groups) load(conversation *models.Conversation, viewerID uint) (*GroupResponse, error) {
+	members, err := g.cs.Members(conversation.ID)
+	if err != nil {
+		return nil, err
+	}
+	return g.newGroupResponse(conversation, members, viewerID)
+}
+
+// announce sends every member of group id a "group.updated"
+// event with the group as they see it, and each of gone a
+// "group.removed" event. Like message pushes, failures are only
+// logged.
+func (g *Groups) announce(id uint, gone ...uint) {
+	for _, userID := range gone {
+		g.push(userID, models.SocketEvent{Type: "group.removed", Data: GroupRemoved{ID: id}})
+	}
+	conversation, err := g.cs.ByID(id)
+	if err == models.ErrNotFound {
+		// The last member left and took the group with them.
+		return
+	}
+	if err != nil {
+		log.Println("groups: announce:", err)
+		return
+	}
+	members, err := g.cs.Members(id)
+	if err != nil {
+		log.Println("groups: announce:", err)
+		return
+	}
+	for _, m := range members {
+		group, err := g.newGroupResponse(conversation, members, m.UserID)
+		if err != nil {
+			log.Println("groups: announce:", err)
+			return
+		}
+		g.push(m.UserID, models.SocketEvent{Type: "group.updated", Data: group})
+	}
+}
+
+func (g *Groups) push(userID uint, event models.SocketEvent) {
+	if err := g.ss.Send(userID, event); err != nil {
+		log.Println("groups: push:", err)
+	}
+}
+
+// newGroupResponse builds the response for conversation as
+// viewerID sees it. Members whose account has been deleted are
+// left out.
+func (g *Groups) newGroupResponse(conversation *models.Conversation, members []models.ConversationMember, viewerID uint) (*GroupResponse, error) {
+	resp := GroupResponse{
+		ID:        conversation.ID,
+		Name:      conversation.Name,
+		Members:   make([]GroupMemberResponse, 0, len(members)),
+		CreatedAt: conversation.CreatedAt,
+		UpdatedAt: conversation.UpdatedAt,
+	}
+	ids := make([]uint, len(members))
+	viewer := false
+	for i, m := range members {
+		ids[i] = m.UserID
+		if m.UserID == viewerID {
+			viewer = true
+			resp.Role = m.Role
+			resp.Muted = m.Muted
+		}
+	}
+	if !viewer {
+		return nil, models.ErrNotFound
+	}
+	users, err := g.us.ByIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]*models.User, len(users))
+	for i := range users {
+		byID[users[i].ID] = &users[i]
+	}
+	for _, m := range members {
+		u, ok := byID[m.UserID]
+		if !ok {
+			continue
+		}
+		resp.Members = append(resp.Members, GroupMemberResponse{
+			User:     newPublicUser(u),
+			Role:     m.Role,
+			JoinedAt: m.JoinedAt,
+		})
+	}
+	return &resp, nil
+}
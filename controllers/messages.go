@@ -0,0 +1,499 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sockets/context"
+	"sockets/models"
+	"sockets/views"
+	"strconv"
+	"time"
+)
+
+type Messages struct {
+	ms models.MessageService
+	cs models.ConversationService
+	ss models.SocketService
+	ts models.TypingService
+}
+
+// MessageForm sends a message to either a user (RecipientID)
+// or a group (ConversationID). ParentID makes it a reply to
+// another message in the same conversation.
+type MessageForm struct {
+	RecipientID    uint   `json:"recipient_id"`
+	ConversationID uint   `json:"conversation_id"`
+	ParentID       uint   `json:"parent_id"`
+	Body           string `json:"body"`
+}
+
+// MessageEditForm is the new body of an edited message.
+type MessageEditForm struct {
+	Body string `json:"body"`
+}
+
+// MessageResponse is a message as its sender and recipients
+// see it. Deleted messages have DeletedAt set and an empty
+// Body so that clients can show a tombstone in their place.
+// Reactions and ReplyCount are only filled in for message
+// history; clients keep them up to date from socket events.
+type MessageResponse struct {
+	ID             uint                   `json:"id"`
+	SenderID       uint                   `json:"sender_id"`
+	RecipientID    uint                   `json:"recipient_id,omitempty"`
+	ConversationID uint                   `json:"conversation_id,omitempty"`
+	ParentID       uint                   `json:"parent_id,omitempty"`
+	Quote          *QuoteResponse         `json:"quote,omitempty"`
+	Body           string                 `json:"body"`
+	CreatedAt      time.Time              `json:"created_at"`
+	EditedAt       *time.Time             `json:"edited_at,omitempty"`
+	DeletedAt      *time.Time             `json:"deleted_at,omitempty"`
+	Reactions      []models.ReactionCount `json:"reactions,omitempty"`
+	ReplyCount     int                    `json:"reply_count,omitempty"`
+}
+
+// QuoteResponse is the parent of a reply as it was when the
+// reply was sent.
+type QuoteResponse struct {
+	SenderID uint   `json:"sender_id"`
+	Body     string `json:"body"`
+}
+
+// ThreadResponse is a message and a page of the replies to
+// it.
+type ThreadResponse struct {
+	Message MessageResponse   `json:"message"`
+	Replies []MessageResponse `json:"replies"`
+}
+
+type ReactionForm struct {
+	Emoji string `json:"emoji"`
+}
+
+// ReactionEvent is the response to reacting, and the data of
+// the "reaction.added" and "reaction.removed" events everyone
+// who can see the message gets.
+type ReactionEvent struct {
+	MessageID uint   `json:"message_id"`
+	UserID    uint   `json:"user_id"`
+	Emoji     string `json:"emoji"`
+}
+
+// ReadForm says how far the current user has read. A zero or
+// missing MessageID means the whole conversation.
+type ReadForm struct {
+	MessageID uint `json:"message_id"`
+}
+
+// ReadReceipt is the response to marking a conversation read,
+// and the data of the "message.read" event the partner gets.
+// UserID is who did the reading.
+type ReadReceipt struct {
+	UserID            uint `json:"user_id"`
+	LastReadMessageID uint `json:"last_read_message_id"`
+}
+
+func NewMessages(ms models.MessageService, cs models.ConversationService, ss models.SocketService, ts models.TypingService) *Messages {
+	return &Messages{
+		ms: ms,
+		cs: cs,
+		ss: ss,
+		ts: ts,
+	}
+}
+
+// Create stores a message and pushes it to every open
+// connection of both the recipient and the sender, or of
+// everyone in the group it was sent to.
+//
+// POST /api/messages
+func (m *Messages) Create(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var form MessageForm
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		views.RenderStatus(w, r, http.StatusBadRequest, "Invalid request body.")
+		return
+	}
+	message := models.Message{
+		SenderID:       user.ID,
+		RecipientID:    form.RecipientID,
+		ConversationID: form.ConversationID,
+		ParentID:       form.ParentID,
+		Body:           form.Body,
+	}
+	if err := m.ms.Create(&message); err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	if message.RecipientID > 0 {
+		m.ts.Stop(message.SenderID, message.RecipientID)
+	}
+	resp := newMessageResponse(&message)
+	m.deliver("message.created", &message, resp)
+	views.RenderJSON(w, http.StatusCreated, resp)
+}
+
+// Update edits a message the current user sent, as long as it
+// is recent enough, and pushes the new version to everyone who
+// can see it.
+//
+// PATCH /api/messages/{id}
+func (m *Messages) Update(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := parseID(r, "id")
+	if err != nil {
+		views.RenderStatus(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	var form MessageEditForm
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		views.RenderStatus(w, r, http.StatusBadRequest, "Invalid request body.")
+		return
+	}
+	message, err := m.ms.Edit(id, user.ID, form.Body)
+	if err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	resp := newMessageResponse(message)
+	m.deliver("message.updated", message, resp)
+	views.RenderJSON(w, http.StatusOK, resp)
+}
+
+// Delete retracts a message the current user sent, as long as
+// it is recent enough. Everyone who can see it is sent its
+// tombstone.
+//
+// DELETE /api/messages/{id}
+func (m *Messages) Delete(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := parseID(r, "id")
+	if err != nil {
+		views.RenderStatus(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	message, err := m.ms.Retract(id, user.ID)
+	if err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	m.deliver("message.deleted", message, newMessageResponse(message))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// React adds the current user's reaction to a message they can
+// see.
+//
+// POST /api/messages/{id}/reactions
+func (m *Messages) React(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := parseID(r, "id")
+	if err != nil {
+		views.RenderStatus(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	var form ReactionForm
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		views.RenderStatus(w, r, http.StatusBadRequest, "Invalid request body.")
+		return
+	}
+	reaction, err := m.ms.React(id, user.ID, form.Emoji)
+	if err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	resp, err := m.pushReaction("reaction.added", reaction)
+	if err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	views.RenderJSON(w, http.StatusCreated, resp)
+}
+
+// Unreact takes back one of the current user's reactions. The
+// emoji goes in the body, as for React.
+//
+// DELETE /api/messages/{id}/reactions
+func (m *Messages) Unreact(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := parseID(r, "id")
+	if err != nil {
+		views.RenderStatus(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	var form ReactionForm
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		views.RenderStatus(w, r, http.StatusBadRequest, "Invalid request body.")
+		return
+	}
+	reaction, err := m.ms.Unreact(id, user.ID, form.Emoji)
+	if err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	if _, err := m.pushReaction("reaction.removed", reaction); err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pushReaction tells everyone who can see the message about
+// reaction and returns the event it sent.
+func (m *Messages) pushReaction(eventType string, reaction *models.Reaction) (*ReactionEvent, error) {
+	message, err := m.ms.ByID(reaction.MessageID)
+	if err != nil {
+		return nil, err
+	}
+	event := ReactionEvent{
+		MessageID: reaction.MessageID,
+		UserID:    reaction.UserID,
+		Emoji:     reaction.Emoji,
+	}
+	m.deliver(eventType, message, event)
+	return &event, nil
+}
+
+// history builds the responses for a page of messages along
+// with their reactions, as userID sees them, and reply counts.
+// Deleted messages keep their reply counts so that clients can
+// still open their threads.
+func (m *Messages) history(userID uint, messages []models.Message) ([]MessageResponse, error) {
+	all := make([]uint, 0, len(messages))
+	live := make([]uint, 0, len(messages))
+	for _, message := range messages {
+		all = append(all, message.ID)
+		if message.DeletedAt == nil {
+			live = append(live, message.ID)
+		}
+	}
+	reactions, err := m.ms.ReactionCounts(live, userID)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := m.ms.ReplyCounts(all)
+	if err != nil {
+		return nil, err
+	}
+	resp := make([]MessageResponse, len(messages))
+	for i := range messages {
+		resp[i] = newMessageResponse(&messages[i])
+		resp[i].Reactions = reactions[messages[i].ID]
+		resp[i].ReplyCount = replies[messages[i].ID]
+	}
+	return resp, nil
+}
+
+// Conversation returns the messages exchanged with another
+// user, oldest first. Pass ?before=<message id> to page back
+// and ?limit= to change the page size.
+//
+// GET /api/conversations/{userID}/messages
+func (m *Messages) Conversation(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	partnerID, err := parseID(r, "userID")
+	if err != nil {
+		views.RenderStatus(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	before, limit, ok := parseMessagePage(w, r)
+	if !ok {
+		return
+	}
+	messages, err := m.ms.Conversation(user.ID, partnerID, before, limit)
+	if err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	resp, err := m.history(user.ID, messages)
+	if err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	views.RenderJSON(w, http.StatusOK, resp)
+}
+
+// Group returns the messages sent to a group the current user
+// is in, oldest first, with the same paging as Conversation.
+//
+// GET /api/groups/{id}/messages
+func (m *Messages) Group(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := parseID(r, "id")
+	if err != nil {
+		views.RenderStatus(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	if _, err := m.cs.Member(id, user.ID); err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	before, limit, ok := parseMessagePage(w, r)
+	if !ok {
+		return
+	}
+	messages, err := m.ms.Group(id, before, limit)
+	if err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	resp, err := m.history(user.ID, messages)
+	if err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	views.RenderJSON(w, http.StatusOK, resp)
+}
+
+// Thread returns a message and the replies to it, oldest
+// first, with the same paging as Conversation.
+//
+// GET /api/messages/{id}/thread
+func (m *Messages) Thread(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := parseID(r, "id")
+	if err != nil {
+		views.RenderStatus(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	before, limit, ok := parseMessagePage(w, r)
+	if !ok {
+		return
+	}
+	parent, replies, err := m.ms.Thread(id, user.ID, before, limit)
+	if err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	resp, err := m.history(user.ID, append([]models.Message{*parent}, replies...))
+	if err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	views.RenderJSON(w, http.StatusOK, ThreadResponse{
+		Message: resp[0],
+		Replies: resp[1:],
+	})
+}
+
+// Read moves the current user's read cursor in the
+// conversation with another user forward and lets that user
+// know their messages were seen.
+//
+// POST /api/conversations/{userID}/read
+func (m *Messages) Read(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	partnerID, err := parseID(r, "userID")
+	if err != nil {
+		views.RenderStatus(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	var form ReadForm
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+			views.RenderStatus(w, r, http.StatusBadRequest, "Invalid request body.")
+			return
+		}
+	}
+	cursor, moved, err := m.ms.MarkRead(user.ID, partnerID, form.MessageID)
+	if err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	receipt := ReadReceipt{
+		UserID:            user.ID,
+		LastReadMessageID: cursor.LastReadMessageID,
+	}
+	// The partner already has a receipt at least this far.
+	if moved {
+		m.push(models.SocketEvent{Type: "message.read", Data: receipt}, partnerID)
+	}
+	views.RenderJSON(w, http.StatusOK, receipt)
+}
+
+// deliver pushes data as an event of the given type to both
+// sides of a direct message, or to everyone in the group a
+// group message was sent to.
+func (m *Messages) deliver(eventType string, message *models.Message, data interface{}) {
+	event := models.SocketEvent{Type: eventType, Data: data}
+	if message.ConversationID > 0 {
+		m.pushGroup(event, message.ConversationID)
+		return
+	}
+	m.push(event, message.SenderID, message.RecipientID)
+}
+
+// push delivers event to each user's open connections. A
+// failed push is not fatal since the message is already saved
+// and will show up in history.
+func (m *Messages) push(event models.SocketEvent, userIDs ...uint) {
+	for _, id := range userIDs {
+		if err := m.ss.Send(id, event); err != nil {
+			log.Println("messages: push:", err)
+		}
+	}
+}
+
+// pushGroup delivers event to every member of group id.
+func (m *Messages) pushGroup(event models.SocketEvent, id uint) {
+	members, err := m.cs.Members(id)
+	if err != nil {
+		log.Println("messages: push:", err)
+		return
+	}
+	ids := make([]uint, len(members))
+	for i, member := range members {
+		ids[i] = member.UserID
+	}
+	m.push(event, ids...)
+}
+
+// parseMessagePage reads the ?before= and ?limit= paging
+// parameters. If either is malformed it writes a 400 and
+// returns false.
+func parseMessagePage(w http.ResponseWriter, r *http.Request) (uint, int, bool) {
+	query := r.URL.Query()
+	var before uint64
+	if s := query.Get("before"); s != "" {
+		var err error
+		if before, err = strconv.ParseUint(s, 10, 32); err != nil {
+			views.RenderStatus(w, r, http.StatusBadRequest, "Invalid before parameter.")
+			return 0, 0, false
+		}
+	}
+	var limit int
+	if s := query.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil {
+			views.RenderStatus(w, r, http.StatusBadRequest, "Invalid limit parameter.")
+			return 0, 0, false
+		}
+	}
+	return uint(before), limit, true
+}
+
+func newMessageResponse(m *models.Message) MessageResponse {
+	resp := MessageResponse{
+		ID:             m.ID,
+		SenderID:       m.SenderID,
+		RecipientID:    m.RecipientID,
+		ConversationID: m.ConversationID,
+		ParentID:       m.ParentID,
+		Body:           m.Body,
+		CreatedAt:      m.CreatedAt,
+		EditedAt:       m.EditedAt,
+		DeletedAt:      m.DeletedAt,
+	}
+	if m.DeletedAt != nil {
+		resp.Body = ""
+		return resp
+	}
+	if m.ParentID > 0 {
+		resp.Quote = &QuoteResponse{
+			SenderID: m.QuoteSenderID,
+			Body:     m.QuoteBody,
+		}
+	}
+	return resp
+}
@@ -0,0 +1,33 @@
+package controllers
+
+import (
+	"net/http"
+	"sockets/context"
+	"sockets/models"
+	"sockets/views"
+)
+
+type Presence struct {
+	ps models.PresenceService
+}
+
+func NewPresence(ps models.PresenceService) *Presence {
+	return &Presence{
+		ps: ps,
+	}
+}
+
+// Friends returns the presence of every accepted friend so the
+// client can draw the friends list before any
+// "presence.changed" events arrive over the socket.
+//
+// GET /api/friends/presence
+func (p *Presence) Friends(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	presences, err := p.ps.Friends(user.ID)
+	if err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	views.RenderJSON(w, http.StatusOK, presences)
+}
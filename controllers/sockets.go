@@ -0,0 +1,31 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"sockets/context"
+	"sockets/models"
+)
+
+type Sockets struct {
+	ss models.SocketService
+}
+
+func NewSockets(ss models.SocketService) *Sockets {
+	return &Sockets{
+		ss: ss,
+	}
+}
+
+// Connect upgrades the request to a WebSocket registered
+// under the current user.
+//
+// GET /api/ws
+func (s *Sockets) Connect(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if err := s.ss.Connect(w, r, user.ID); err != nil {
+		// The response has already been written by the upgrader
+		// or the connection has been hijacked, so just log it.
+		log.Println("sockets: connect:", err)
+	}
+}
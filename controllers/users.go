@@ -2,23 +2,51 @@ package controllers
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
+	"sockets/context"
 	"sockets/models"
+	"sockets/token"
+	"sockets/views"
 	"strconv"
-	"strings"
 	"time"
-
-	"github.com/dgrijalva/jwt-go"
 )
 
+// AccessTokenTTL is how long an access token is good for.
+// Clients are expected to trade their refresh token for a new
+// one before it runs out.
+const AccessTokenTTL = 15 * time.Minute
+
 type Users struct {
 	us models.UserService
+	fs models.FriendService
+	ss models.SessionService
+	ts *token.Issuer
+}
+
+// TokenResponse is what logging in, signing up and refreshing
+// hand back. ExpiresAt is when Token expires, in Unix seconds.
+type TokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresAt    int64  `json:"expires_at"`
+}
+
+type RefreshForm struct {
+	RefreshToken string `json:"refresh_token"`
 }
 
 type UserResponse struct {
-	Name  string
-	Email string
+	Name   string
+	Email  string
+	Handle string
+}
+
+// PublicUser is the part of a user that anyone may see. It is
+// what we hand out about users other than the current one.
+type PublicUser struct {
+	ID     uint   `json:"id"`
+	Handle string `json:"handle"`
+	Name   string `json:"name"`
 }
 
 type SignupForm struct {
@@ -36,43 +64,70 @@ type LoginForm struct {
 // This function will panic if the templates are not
 // parsed correctly, and should only be used during
 // initial setup.
-func NewUsers(us models.UserService) *Users {
+func NewUsers(us models.UserService, fs models.FriendService, ss models.SessionService, ts *token.Issuer) *Users {
 	return &Users{
 		us: us,
+		fs: fs,
+		ss: ss,
+		ts: ts,
 	}
 }
 
-// Load decodes a JWT token and returns the user
+// JWKS publishes the public keys our access tokens can be
+// verified with, so other services can check them without
+// calling us.
+//
+// GET /.well-known/jwks.json
+func (u *Users) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	views.RenderJSON(w, http.StatusOK, u.ts.JWKS())
+}
+
+// Load returns the user the request's access token belongs
+// to.
+//
+// GET /api/auth
 func (u *Users) Load(w http.ResponseWriter, r *http.Request) {
-	tokenString := u.extractToken(r)
-	fmt.Println("tokenString: ", tokenString)
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing algo")
+	user := context.User(r.Context())
+	payload := UserResponse{
+		Name:   user.Name,
+		Email:  user.Email,
+		Handle: user.Handle,
+	}
+	views.RenderJSON(w, http.StatusOK, payload)
+}
+
+// Search looks users up by handle or name prefix for the add
+// friend dialog. Users who blocked the caller never show up.
+//
+// GET /api/users/search?q=
+func (u *Users) Search(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	query := r.URL.Query()
+	var limit int
+	if s := query.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil {
+			views.RenderStatus(w, r, http.StatusBadRequest, "Invalid limit parameter.")
+			return
 		}
-		return []byte(u.us.JwtSecret()), nil
-	})
+	}
+	exclude, err := u.fs.BlockedByIDs(user.ID)
 	if err != nil {
-		panic(err)
-	}
-	fmt.Println("token: ", token)
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if ok && token.Valid {
-		uid, err := strconv.ParseUint(fmt.Sprintf("%.0f", claims["user_id"]), 10, 32)
-		if err != nil {
-			panic(err)
-		}
-		user, err := u.us.ByID(uint(uid))
-		if err != nil {
-			panic(err)
-		}
-		payload := UserResponse{
-			Name:  user.Name,
-			Email: user.Email,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(payload)
+		views.RenderError(w, r, err)
+		return
+	}
+	exclude = append(exclude, user.ID)
+	users, err := u.us.Search(query.Get("q"), exclude, limit)
+	if err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	resp := make([]PublicUser, len(users))
+	for i := range users {
+		resp[i] = newPublicUser(&users[i])
 	}
+	views.RenderJSON(w, http.StatusOK, resp)
 }
 
 // Create is used to process the signup form when a user
@@ -81,20 +136,21 @@ func (u *Users) Load(w http.ResponseWriter, r *http.Request) {
 // POST /signup
 func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 	var user models.User
-	json.NewDecoder(r.Body).Decode(&user)
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		views.RenderStatus(w, r, http.StatusBadRequest, "Invalid request body.")
+		return
+	}
 
 	if err := u.us.Create(&user); err != nil {
-		panic(err)
-	}
-	jwtToken, err := u.signIn(w, &user)
-	if err != nil {
-		http.Redirect(w, r, "/login", http.StatusFound)
+		views.RenderError(w, r, err)
 		return
 	}
-	err = json.NewEncoder(w).Encode(jwtToken)
+	tokens, err := u.signIn(r, &user)
 	if err != nil {
-		panic(err)
+		views.RenderError(w, r, err)
+		return
 	}
+	views.RenderJSON(w, http.StatusOK, tokens)
 }
 
 // Login is used to verify the provided email address and
@@ -102,71 +158,134 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 //
 // POST /login
 func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("login", r)
 	var login models.User
-	json.NewDecoder(r.Body).Decode(&login)
-	fmt.Println("login", r)
+	if err := json.NewDecoder(r.Body).Decode(&login); err != nil {
+		views.RenderStatus(w, r, http.StatusBadRequest, "Invalid request body.")
+		return
+	}
 
 	user, err := u.us.Authenticate(login.Email, login.Password)
 	if err != nil {
 		switch err {
-		case models.ErrNotFound:
-
+		case models.ErrNotFound, models.ErrPasswordIncorrect:
+			// Don't tell people which of the two was wrong.
+			views.RenderStatus(w, r, http.StatusUnauthorized, "Invalid email address or password.")
 		default:
-
+			views.RenderError(w, r, err)
 		}
-		http.Redirect(w, r, "/login", http.StatusUnauthorized)
 		return
 	}
 
-	jwtToken, err := u.signIn(w, user)
+	tokens, err := u.signIn(r, user)
+	if err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	views.RenderJSON(w, http.StatusOK, tokens)
+}
+
+// Refresh trades a refresh token for a new access token and
+// refresh token. Each refresh token only works once; if one is
+// presented twice the session is revoked.
+//
+// POST /api/token/refresh
+func (u *Users) Refresh(w http.ResponseWriter, r *http.Request) {
+	var form RefreshForm
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		views.RenderStatus(w, r, http.StatusBadRequest, "Invalid request body.")
+		return
+	}
+	claims, err := u.ts.NewClaims(AccessTokenTTL)
+	if err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	refresh, err := u.ss.Rotate(form.RefreshToken, claims.Id, claims.ExpiresAtTime())
+	if err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	user, err := u.us.ByID(refresh.UserID)
 	if err != nil {
-		http.Redirect(w, r, "/login", http.StatusUnauthorized)
+		if err == models.ErrNotFound {
+			err = models.ErrTokenInvalid
+		}
+		views.RenderError(w, r, err)
 		return
 	}
-	err = json.NewEncoder(w).Encode(jwtToken)
+	claims.SetUserID(user.ID)
+	access, err := u.ts.Sign(claims)
 	if err != nil {
-		panic(err)
+		views.RenderError(w, r, err)
+		return
 	}
+	views.RenderJSON(w, http.StatusOK, TokenResponse{
+		Token:        access,
+		RefreshToken: refresh.Token,
+		ExpiresAt:    claims.ExpiresAt,
+	})
 }
 
-// Logout is used to delete a users session cookie (remember_token)
-// and then will update the user resource with a new remmeber
-// token.
+// Logout revokes the access token used to make the request
+// along with the session it belongs to.
 //
-// POST /logout
+// POST /api/logout
 func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
-	// kill jwt token
-	http.Redirect(w, r, "/", http.StatusFound)
+	jti := context.TokenID(r.Context())
+	// The exact expiry doesn't matter as long as the revocation
+	// outlives the token, and no token lives longer than this.
+	if err := u.ss.End(jti, time.Now().Add(AccessTokenTTL)); err != nil {
+		views.RenderError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
-// signIn is used to sign the given user in via cookies
-func (u *Users) signIn(w http.ResponseWriter, user *models.User) (string, error) {
-	token, err := u.createToken(user)
-	if err != nil {
-		panic(err)
+// LogoutAll revokes every session of the current user, logging
+// them out on all of their devices.
+//
+// POST /api/logout/all
+func (u *Users) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if err := u.ss.EndAll(user.ID); err != nil {
+		views.RenderError(w, r, err)
+		return
 	}
-
-	return token, nil
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func (u *Users) createToken(user *models.User) (string, error) {
-	claims := jwt.MapClaims{}
-	claims["user_id"] = user.ID
-	claims["exp"] = time.Now().Add(time.Hour * 1).Unix()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(u.us.JwtSecret()))
+// signIn starts a new session for the given user and returns
+// its first pair of tokens.
+func (u *Users) signIn(r *http.Request, user *models.User) (*TokenResponse, error) {
+	access, claims, err := u.ts.Issue(user.ID, AccessTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := u.ss.Start(user.ID, device(r), claims.Id, claims.ExpiresAtTime())
+	if err != nil {
+		return nil, err
+	}
+	return &TokenResponse{
+		Token:        access,
+		RefreshToken: refresh.Token,
+		ExpiresAt:    claims.ExpiresAt,
+	}, nil
 }
 
-func (u *Users) extractToken(r *http.Request) string {
-	keys := r.URL.Query()
-	token := keys.Get("token")
-	if token != "" {
-		return token
+// device describes the client a session was started from so
+// that users can tell their sessions apart.
+func device(r *http.Request) string {
+	ua := r.UserAgent()
+	if len(ua) > 255 {
+		ua = ua[:255]
 	}
-	bearerToken := r.Header.Get("Authorization")
-	if len(strings.Split(bearerToken, " ")) == 2 {
-		return strings.Split(bearerToken, " ")[1]
+	return ua
+}
+
+func newPublicUser(user *models.User) PublicUser {
+	return PublicUser{
+		ID:     user.ID,
+		Handle: user.Handle,
+		Name:   user.Name,
 	}
-	return ""
 }
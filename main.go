@@ -1,21 +1,26 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sockets/controllers"
 	"sockets/middleware"
 	"sockets/models"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/handlers"
 
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	_ "github.com/lib/pq"
 )
 
@@ -45,38 +50,141 @@ func (h spaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	boolPtr := flag.Bool("prod", false, "Provide this flag in production. This ensures that a .config file is provided before the application starts.")
+	configPath := flag.String("config", ".config", "Path to the JSON config file. Any setting in it can be overridden by a SOCKETS_* environment variable, e.g. SOCKETS_DATABASE_HOST.")
+	boolPtr := flag.Bool("prod", false, "Provide this flag in production. This ensures that a config file is provided and that the config is safe for production before the application starts.")
+	flag.Int("port", 0, "Port to listen on. Overrides the port setting.")
+	flag.String("env", "", "Environment to run in (dev or prod). Overrides the env setting.")
+	flag.Bool("auto-migrate", true, "Apply pending schema migrations at startup. Overrides the auto_migrate setting.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [migrate up|down|status|redo]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	cfg := LoadConfig(*boolPtr)
+	// settingFlags maps the flags that override a config setting
+	// onto that setting's path.
+	settingFlags := map[string]string{
+		"port":         "port",
+		"env":          "env",
+		"auto-migrate": "auto_migrate",
+	}
+	var overrides []FlagOverride
+	flag.Visit(func(f *flag.Flag) {
+		if path, ok := settingFlags[f.Name]; ok {
+			overrides = append(overrides, FlagOverride{Path: path, Flag: f.Name, Value: f.Value.String()})
+		}
+	})
+
+	cfg, sources, err := LoadConfig(*configPath, *boolPtr, overrides)
+	if err != nil {
+		log.Fatal(err)
+	}
+	warnings, err := CheckConfig(cfg, sources, *boolPtr || cfg.IsProd())
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, w := range warnings {
+		fmt.Println("WARNING config:", w)
+	}
+	if overridden := sources.Overridden(); len(overridden) > 0 {
+		fmt.Printf("Config settings not at their defaults:\n  %s\n", strings.Join(overridden, "\n  "))
+	} else {
+		fmt.Println("Using the default config...")
+	}
 	dbCfg := cfg.Database
+	if flag.Arg(0) == "migrate" {
+		services, err := models.NewServices(
+			models.WithGorm(dbCfg.Dialect(), dbCfg.ConnectionInfo(), dbCfg.Pool()),
+		)
+		must(err)
+		err = runMigrate(services, flag.Arg(1))
+		services.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	tokens, err := cfg.TokenIssuer()
+	must(err)
 	services, err := models.NewServices(
-		models.WithGorm(dbCfg.Dialect(), dbCfg.ConnectionInfo()),
+		models.WithGorm(dbCfg.Dialect(), dbCfg.ConnectionInfo(), dbCfg.Pool()),
 		models.WithLogMode(!cfg.IsProd()),
-		models.WithUser(cfg.Pepper, cfg.JWTSecret),
+		models.WithUser(cfg.Pepper),
+		models.WithSession(),
 		models.WithFriend(),
+		models.WithConversation(),
+		models.WithMessage(cfg.EditWindow()),
+		models.WithSocket(),
+		models.WithPresence(),
+		models.WithTyping(),
 	)
 	must(err)
-	defer services.Close()
-	services.AutoMigrate()
+	if cfg.AutoMigrate {
+		applied, err := services.MigrateUp()
+		must(err)
+		for _, m := range applied {
+			fmt.Printf("Applied migration %d %s\n", m.Version, m.Name)
+		}
+	}
 
 	userMw := middleware.User{
 		UserService: services.User,
+		Sessions:    services.Session,
+		Tokens:      tokens,
 	}
 	requireUserMw := middleware.RequireUser{
 		User: userMw,
 	}
+	recoverMw := middleware.Recover{}
 
 	r := mux.NewRouter()
-	usersC := controllers.NewUsers(services.User)
-	friendsC := controllers.NewFriends(services.Friend, r)
+	usersC := controllers.NewUsers(services.User, services.Friend, services.Session, tokens)
+	friendsC := controllers.NewFriends(services.Friend, services.User, services.Message, r)
+	blocksC := controllers.NewBlocks(services.Friend, services.User)
+	socketsC := controllers.NewSockets(services.Socket)
+	presenceC := controllers.NewPresence(services.Presence)
+	groupsC := controllers.NewGroups(services.Conversation, services.User, services.Socket)
+	messagesC := controllers.NewMessages(services.Message, services.Conversation, services.Socket, services.Typing)
 
-	r.HandleFunc("/api/auth", usersC.Load).Methods("GET")
+	r.HandleFunc("/.well-known/jwks.json", usersC.JWKS).Methods("GET")
+	r.HandleFunc("/api/auth", requireUserMw.ApplyFn(usersC.Load)).Methods("GET")
 	r.HandleFunc("/api/signup", usersC.Create).Methods("POST")
 	r.HandleFunc("/api/login", usersC.Login).Methods("POST")
+	r.HandleFunc("/api/token/refresh", usersC.Refresh).Methods("POST")
 	r.HandleFunc("/api/logout", requireUserMw.ApplyFn(usersC.Logout)).Methods("POST")
-	r.HandleFunc("/api/friends", friendsC.Index).Methods("GET")
-	r.HandleFunc("/api/friends", friendsC.Create).Methods("POST")
+	r.HandleFunc("/api/logout/all", requireUserMw.ApplyFn(usersC.LogoutAll)).Methods("POST")
+	r.HandleFunc("/api/users/search", requireUserMw.ApplyFn(usersC.Search)).Methods("GET")
+	r.HandleFunc("/api/friends", requireUserMw.ApplyFn(friendsC.Index)).Methods("GET")
+	r.HandleFunc("/api/friends", requireUserMw.ApplyFn(friendsC.Create)).Methods("POST")
+	r.HandleFunc("/api/friends/presence", requireUserMw.ApplyFn(presenceC.Friends)).Methods("GET")
+	r.HandleFunc("/api/friends/{id:[0-9]+}/accept", requireUserMw.ApplyFn(friendsC.Accept)).Methods("POST")
+	r.HandleFunc("/api/friends/{id:[0-9]+}/decline", requireUserMw.ApplyFn(friendsC.Decline)).Methods("POST")
+	r.HandleFunc("/api/friends/{id:[0-9]+}", requireUserMw.ApplyFn(friendsC.Delete)).Methods("DELETE")
+	r.HandleFunc("/api/blocks", requireUserMw.ApplyFn(blocksC.Index)).Methods("GET")
+	r.HandleFunc("/api/blocks/{userID:[0-9]+}", requireUserMw.ApplyFn(blocksC.Create)).Methods("POST")
+	r.HandleFunc("/api/blocks/{userID:[0-9]+}", requireUserMw.ApplyFn(blocksC.Delete)).Methods("DELETE")
+	r.HandleFunc("/api/groups", requireUserMw.ApplyFn(groupsC.Index)).Methods("GET")
+	r.HandleFunc("/api/groups", requireUserMw.ApplyFn(groupsC.Create)).Methods("POST")
+	r.HandleFunc("/api/groups/{id:[0-9]+}", requireUserMw.ApplyFn(groupsC.Show)).Methods("GET")
+	r.HandleFunc("/api/groups/{id:[0-9]+}", requireUserMw.ApplyFn(groupsC.Update)).Methods("PATCH")
+	r.HandleFunc("/api/groups/{id:[0-9]+}/members", requireUserMw.ApplyFn(groupsC.AddMembers)).Methods("POST")
+	r.HandleFunc("/api/groups/{id:[0-9]+}/members/{userID:[0-9]+}", requireUserMw.ApplyFn(groupsC.UpdateMember)).Methods("PATCH")
+	r.HandleFunc("/api/groups/{id:[0-9]+}/members/{userID:[0-9]+}", requireUserMw.ApplyFn(groupsC.RemoveMember)).Methods("DELETE")
+	r.HandleFunc("/api/groups/{id:[0-9]+}/leave", requireUserMw.ApplyFn(groupsC.Leave)).Methods("POST")
+	r.HandleFunc("/api/groups/{id:[0-9]+}/owner", requireUserMw.ApplyFn(groupsC.Transfer)).Methods("POST")
+	r.HandleFunc("/api/groups/{id:[0-9]+}/mute", requireUserMw.ApplyFn(groupsC.Mute)).Methods("POST")
+	r.HandleFunc("/api/groups/{id:[0-9]+}/mute", requireUserMw.ApplyFn(groupsC.Unmute)).Methods("DELETE")
+	r.HandleFunc("/api/groups/{id:[0-9]+}/messages", requireUserMw.ApplyFn(messagesC.Group)).Methods("GET")
+	r.HandleFunc("/api/messages", requireUserMw.ApplyFn(messagesC.Create)).Methods("POST")
+	r.HandleFunc("/api/messages/{id:[0-9]+}", requireUserMw.ApplyFn(messagesC.Update)).Methods("PATCH")
+	r.HandleFunc("/api/messages/{id:[0-9]+}", requireUserMw.ApplyFn(messagesC.Delete)).Methods("DELETE")
+	r.HandleFunc("/api/messages/{id:[0-9]+}/thread", requireUserMw.ApplyFn(messagesC.Thread)).Methods("GET")
+	r.HandleFunc("/api/messages/{id:[0-9]+}/reactions", requireUserMw.ApplyFn(messagesC.React)).Methods("POST")
+	r.HandleFunc("/api/messages/{id:[0-9]+}/reactions", requireUserMw.ApplyFn(messagesC.Unreact)).Methods("DELETE")
+	r.HandleFunc("/api/conversations/{userID:[0-9]+}/messages", requireUserMw.ApplyFn(messagesC.Conversation)).Methods("GET")
+	r.HandleFunc("/api/conversations/{userID:[0-9]+}/read", requireUserMw.ApplyFn(messagesC.Read)).Methods("POST")
+	r.HandleFunc("/api/ws", requireUserMw.ApplyFn(socketsC.Connect)).Methods("GET")
 
 	spa := spaHandler{staticPath: "client/build", indexPath: "index.html"}
 	r.PathPrefix("/").Handler(spa)
@@ -84,10 +192,11 @@ func main() {
 	fmt.Printf("Starting the server on :%d...\n", cfg.Port)
 
 	headersOk := handlers.AllowedHeaders([]string{"Accept", "Content-Type", "Content-Length", "Accept-Encoding", "Authorization"})
+	exposedOk := handlers.ExposedHeaders([]string{"X-Request-ID", "WWW-Authenticate"})
 	originsOk := handlers.AllowedOrigins([]string{"http://localhost:3000", "http://localhost:5000"})
-	methodsOk := handlers.AllowedMethods([]string{"POST", "GET", "OPTIONS", "PUT", "DELETE"})
+	methodsOk := handlers.AllowedMethods([]string{"POST", "GET", "OPTIONS", "PUT", "PATCH", "DELETE"})
 	credentialsOk := handlers.AllowCredentials()
-	corsHandler := handlers.CORS(originsOk, headersOk, methodsOk, credentialsOk)(userMw.Apply(r))
+	corsHandler := handlers.CORS(originsOk, headersOk, exposedOk, methodsOk, credentialsOk)(recoverMw.Apply(userMw.Apply(r)))
 
 	srv := &http.Server{
 		Handler:      corsHandler,
@@ -95,7 +204,34 @@ func main() {
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
 	}
-	log.Fatal(srv.ListenAndServe())
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-serverErr:
+		services.Close()
+		log.Fatal(err)
+	case sig := <-stop:
+		fmt.Printf("Received %s, shutting down...\n", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownDeadline())
+	defer cancel()
+	// Stop taking new requests and let in-flight ones finish
+	// first, since they may still push to sockets. Shutdown
+	// doesn't wait for hijacked connections, so the socket hub
+	// is drained separately by services.Shutdown.
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("http shutdown:", err)
+	}
+	if err := services.Shutdown(ctx); err != nil {
+		log.Println("services shutdown:", err)
+	}
+	fmt.Println("Server stopped")
 }
 
 func must(err error) {
@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"sockets/context"
+	"sockets/rand"
+	"sockets/views"
+)
+
+// Recover tags every request with an ID and turns a panic in
+// any handler further down the chain into a logged 500 JSON
+// response instead of a dropped connection.
+type Recover struct{}
+
+func (mw *Recover) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *Recover) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := rand.Hex(8)
+		if err != nil {
+			// Not worth failing the request over.
+			id = "unknown"
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(context.WithRequestID(r.Context(), id))
+		sw := &sentWriter{ResponseWriter: w}
+
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				// The server knows to abort quietly.
+				panic(rec)
+			}
+			log.Printf("[%s] panic: %v\n%s", id, rec, debug.Stack())
+			if sw.sent {
+				// Too late for a clean error; the client gets
+				// whatever was written before the panic.
+				return
+			}
+			views.RenderError(w, r, fmt.Errorf("panic: %v", rec))
+		}()
+		next(sw, r)
+	})
+}
+
+// sentWriter notes whether the response has been started, so
+// that Recover does not write a second status line into it.
+// It passes Hijack and Flush through for sockets and streams.
+type sentWriter struct {
+	http.ResponseWriter
+	sent bool
+}
+
+func (w *sentWriter) WriteHeader(status int) {
+	w.sent = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *sentWriter) Write(b []byte) (int, error) {
+	w.sent = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *sentWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("middleware: response writer cannot be hijacked")
+	}
+	w.sent = true
+	return hj.Hijack()
+}
+
+func (w *sentWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.sent = true
+		f.Flush()
+	}
+}
@@ -5,79 +5,100 @@ import (
 	"net/http"
 	"sockets/context"
 	"sockets/models"
-	"strconv"
+	"sockets/token"
+	"sockets/views"
 	"strings"
-
-	"github.com/dgrijalva/jwt-go"
 )
 
 type User struct {
 	models.UserService
+	Sessions models.SessionService
+	Tokens   *token.Issuer
 }
 
 func (mw *User) extractToken(r *http.Request) string {
 	keys := r.URL.Query()
-	fmt.Println("keys:", keys)
 	token := keys.Get("token")
 	if token != "" {
 		return token
 	}
 	bearerToken := r.Header.Get("Authorization")
-	fmt.Println(bearerToken)
 	if len(strings.Split(bearerToken, " ")) == 2 {
 		return strings.Split(bearerToken, " ")[1]
 	}
 	return ""
 }
 
-func (mw *User) extractUser(tokenString string) uint {
-	fmt.Println("tokenString", tokenString)
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing algo")
-		}
-		return []byte(mw.JwtSecret()), nil
-	})
+// extractUser verifies tokenString and checks that it hasn't
+// been revoked, returning its claims. A token that doesn't
+// check out is reported through the TokenState rather than an
+// error, since to us it just means the request is anonymous.
+func (mw *User) extractUser(tokenString string) (*token.Claims, context.TokenState, error) {
+	if tokenString == "" {
+		return nil, context.TokenMissing, nil
+	}
+	claims, err := mw.Tokens.Verify(tokenString)
+	switch err {
+	case nil:
+	case token.ErrMalformed:
+		return nil, context.TokenMalformed, nil
+	case token.ErrExpired:
+		return nil, context.TokenExpired, nil
+	default:
+		return nil, context.TokenInvalid, nil
+	}
+	revoked, err := mw.Sessions.IsRevoked(claims.Id)
 	if err != nil {
-		panic(err)
+		return nil, context.TokenInvalid, err
 	}
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if ok && token.Valid {
-		uid, err := strconv.ParseUint(fmt.Sprintf("%.0f", claims["user_id"]), 10, 32)
-		if err != nil {
-			panic(err)
-		}
-		return uint(uid)
+	if revoked {
+		return nil, context.TokenRevoked, nil
 	}
-	return 0
+	return claims, context.TokenValid, nil
 }
 
 func (mw *User) Apply(next http.Handler) http.HandlerFunc {
 	return mw.ApplyFn(next.ServeHTTP)
 }
 
+// ApplyFn looks up the user a request's token was issued to
+// and stores it in the request context. Requests with no
+// token, or one that doesn't check out, carry on anonymously
+// with the reason recorded by context.WithTokenState.
 func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		path := r.URL.Path
 
 		if strings.HasPrefix(path, "/api/login") ||
-			strings.HasPrefix(path, "/api/register") ||
-			strings.HasPrefix(path, "/api/auth") {
+			strings.HasPrefix(path, "/api/signup") ||
+			strings.HasPrefix(path, "/api/token") ||
+			strings.HasPrefix(path, "/.well-known/") {
 			next(w, r)
 			return
 		}
 
-		tokenString := mw.extractToken(r)
-		userID := mw.extractUser(tokenString)
-		user, err := mw.UserService.ByID(userID)
+		ctx := r.Context()
+		claims, state, err := mw.extractUser(mw.extractToken(r))
 		if err != nil {
-			next(w, r)
+			views.RenderError(w, r, err)
 			return
 		}
-
-		ctx := r.Context()
-		ctx = context.WithUser(ctx, user)
+		if state == context.TokenValid {
+			userID, _ := claims.UserID()
+			user, err := mw.UserService.ByID(userID)
+			switch err {
+			case nil:
+				ctx = context.WithUser(ctx, user)
+				ctx = context.WithTokenID(ctx, claims.Id)
+			case models.ErrNotFound:
+				state = context.TokenInvalid
+			default:
+				views.RenderError(w, r, err)
+				return
+			}
+		}
+		ctx = context.WithTokenState(ctx, state)
 		r = r.WithContext(ctx)
 		next(w, r)
 	})
@@ -97,13 +118,38 @@ func (mw *RequireUser) Apply(next http.Handler) http.HandlerFunc {
 
 // ApplyFn assumes that User middleware has already been run
 // otherwise it will no work correctly.
+//
+// Anonymous API requests get a 401 with a WWW-Authenticate
+// challenge (RFC 6750) saying why; anything else is sent to the
+// login page.
 func (mw *RequireUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := context.User(r.Context())
-		if user == nil {
+		if user != nil {
+			next(w, r)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
 			http.Redirect(w, r, "/login", http.StatusFound)
 			return
 		}
-		next(w, r)
+
+		state := context.Token(r.Context())
+		challenge := `Bearer realm="sockets"`
+		message := "You must be logged in to do that."
+		switch state {
+		case context.TokenMissing:
+		case context.TokenExpired:
+			challenge += `, error="invalid_token", error_description="The access token expired"`
+			message = "Your session has expired. Please log in again."
+		case context.TokenRevoked:
+			challenge += `, error="invalid_token", error_description="The access token was revoked"`
+			message = "You have been logged out. Please log in again."
+		default:
+			challenge += fmt.Sprintf(`, error="invalid_token", error_description="The access token is %s"`, state)
+			message = "Your session is not valid. Please log in again."
+		}
+		w.Header().Set("WWW-Authenticate", challenge)
+		views.RenderStatus(w, r, http.StatusUnauthorized, message)
 	})
 }
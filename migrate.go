@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"sockets/models"
+	"time"
+)
+
+// runMigrate carries out the "migrate" subcommand.
+func runMigrate(services *models.Services, cmd string) error {
+	switch cmd {
+	case "up":
+		applied, err := services.MigrateUp()
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("Nothing to migrate.")
+		}
+		for _, m := range applied {
+			fmt.Printf("Applied %d %s\n", m.Version, m.Name)
+		}
+	case "down":
+		m, err := services.MigrateDown()
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			fmt.Println("Nothing to roll back.")
+			return nil
+		}
+		fmt.Printf("Rolled back %d %s\n", m.Version, m.Name)
+	case "redo":
+		m, err := services.MigrateRedo()
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			fmt.Println("Nothing to redo.")
+			return nil
+		}
+		fmt.Printf("Redid %d %s\n", m.Version, m.Name)
+	case "status":
+		statuses, err := services.Migrations()
+		if err != nil {
+			return err
+		}
+		for _, m := range statuses {
+			applied := "pending"
+			if m.AppliedAt != nil {
+				applied = "applied " + m.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-24s %s\n", m.Version, m.Name, applied)
+		}
+	default:
+		return fmt.Errorf("usage: migrate up|down|status|redo, got %q", cmd)
+	}
+	return nil
+}
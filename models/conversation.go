@@ -0,0 +1,681 @@
+package models
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// conversationNameMaxLength is the longest group name, in
+	// characters, that we will store.
+	conversationNameMaxLength = 100
+	// MaxConversationMembers caps how many people, owner
+	// included, can be in one group.
+	MaxConversationMembers = 100
+)
+
+// ConversationRole is what a member may do in a group. The
+// owner can do anything. Admins can rename the group and add
+// and remove members, but not other admins. Members can only
+// talk, mute the group and leave.
+type ConversationRole string
+
+const (
+	RoleOwner  ConversationRole = "owner"
+	RoleAdmin  ConversationRole = "admin"
+	RoleMember ConversationRole = "member"
+)
+
+// Valid reports whether r is one of the known roles.
+func (r ConversationRole) Valid() bool {
+	switch r {
+	case RoleOwner, RoleAdmin, RoleMember:
+		return true
+	}
+	return false
+}
+
+// manages reports whether someone with role r may change the
+// group and remove members with role other from it.
+func (r ConversationRole) manages(other ConversationRole) bool {
+	switch r {
+	case RoleOwner:
+		return other != RoleOwner
+	case RoleAdmin:
+		return other == RoleMember
+	}
+	return false
+}
+
+// Conversation is a group chat. Who is in it, and what they
+// may do there, is kept in its ConversationMember rows; there
+// is always exactly one RoleOwner among them.
+type Conversation struct {
+	gorm.Model
+	Name string `gorm:"not null"`
+}
+
+// ConversationMember puts a user in a Conversation. The
+// database allows at most one live row per (ConversationID,
+// UserID). Muted is the member's own choice and only affects
+// notifications; muted members still get every message.
+type ConversationMember struct {
+	gorm.Model
+	ConversationID uint             `gorm:"not null;index"`
+	UserID         uint             `gorm:"not null;index"`
+	Role           ConversationRole `gorm:"not null"`
+	JoinedAt       time.Time        `gorm:"not null"`
+	Muted          bool             `gorm:"not null"`
+}
+
+// ConversationService manages groups on behalf of their
+// members. Every method that acts for a user returns
+// ErrNotFound if they are not in the group, so that outsiders
+// cannot tell which groups exist.
+type ConversationService interface {
+	// Start creates a group called name owned by ownerID with
+	// memberIDs in it, who must all be accepted friends of
+	// ownerID.
+	Start(ownerID uint, name string, memberIDs []uint) (*Conversation, error)
+	// Rename changes the name of group id. actorID must be its
+	// owner or an admin.
+	Rename(id, actorID uint, name string) (*Conversation, error)
+	// AddMembers adds userIDs to group id as members and
+	// returns their new rows. actorID must be its owner or an
+	// admin, and each user must be an accepted friend of
+	// actorID.
+	AddMembers(id, actorID uint, userIDs []uint) ([]ConversationMember, error)
+	// RemoveMember takes userID out of group id. Admins can
+	// remove members and the owner can remove anyone. Removing
+	// yourself is the same as Leave.
+	RemoveMember(id, actorID, userID uint) error
+	// Leave takes userID out of group id. The owner has to
+	// transfer ownership first, unless they are the last one
+	// left, in which case the group is deleted.
+	Leave(id, userID uint) error
+	// TransferOwnership makes newOwnerID, who must already be
+	// in the group, its owner. ownerID must be the current
+	// owner and becomes an admin.
+	TransferOwnership(id, ownerID, newOwnerID uint) error
+	// SetRole makes userID an admin or a plain member of group
+	// id. Only the owner can do this.
+	SetRole(id, actorID, userID uint, role ConversationRole) (*ConversationMember, error)
+	// SetMuted mutes or unmutes group id for userID.
+	SetMuted(id, userID uint, muted bool) (*ConversationMember, error)
+	ConversationDB
+}
+
+type ConversationDB interface {
+	ByID(id uint) (*Conversation, error)
+	// ByUserID returns the groups userID is in, newest first.
+	ByUserID(userID uint) ([]Conversation, error)
+	// Create stores conversation along with its first members,
+	// all or nothing, so a group never exists without its
+	// owner. The members' ConversationID is filled in.
+	Create(conversation *Conversation, members []ConversationMember) error
+	Update(conversation *Conversation) error
+	Delete(id uint) error
+	// Members returns everyone in conversationID in the order
+	// they joined.
+	Members(conversationID uint) ([]ConversationMember, error)
+	// Member returns userID's row in conversationID, or
+	// ErrNotFound if they aren't in it.
+	Member(conversationID, userID uint) (*ConversationMember, error)
+	// CreateMembers stores members, all or nothing.
+	CreateMembers(members []ConversationMember) error
+	UpdateMember(member *ConversationMember) error
+	// DeleteMember deletes the member row id.
+	DeleteMember(id uint) error
+	// HandOver makes next the owner and owner an admin, all or
+	// nothing. It fails with ErrConversationForbidden if owner
+	// is no longer the owner by the time it runs.
+	HandOver(owner, next *ConversationMember) error
+	// DeleteWithLastMember deletes conversation id along with
+	// memberID, all or nothing. It fails with
+	// ErrConversationOwnerLeaving if anyone else is still in it.
+	DeleteWithLastMember(id, memberID uint) error
+}
+
+type conversationService struct {
+	ConversationDB
+	friends FriendDB
+}
+
+type conversationValidator struct {
+	ConversationDB
+}
+
+type conversationGorm struct {
+	db *gorm.DB
+}
+
+type conversationValFunc func(*Conversation) error
+
+func runConversationValFuncs(conversation *Conversation, fns ...conversationValFunc) error {
+	for _, fn := range fns {
+		if err := fn(conversation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type conversationMemberValFunc func(*ConversationMember) error
+
+func runConversationMemberValFuncs(member *ConversationMember, fns ...conversationMemberValFunc) error {
+	for _, fn := range fns {
+		if err := fn(member); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewConversationService needs the FriendDB so that people can
+// only put their friends in a group.
+func NewConversationService(db *gorm.DB, friends FriendDB) ConversationService {
+	return newConversationService(&conversationGorm{db}, friends)
+}
+
+func newConversationService(cdb ConversationDB, friends FriendDB) ConversationService {
+	return &conversationService{
+		ConversationDB: &conversationValidator{cdb},
+		friends:        friends,
+	}
+}
+
+func (cs *conversationService) Start(ownerID uint, name string, memberIDs []uint) (*Conversation, error) {
+	memberIDs = uniqueIDs(memberIDs, ownerID)
+	if len(memberIDs) == 0 {
+		return nil, ErrConversationMembersRequired
+	}
+	if len(memberIDs)+1 > MaxConversationMembers {
+		return nil, ErrConversationTooLarge
+	}
+	if err := cs.friendsOnly(ownerID, memberIDs); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	members := []ConversationMember{{
+		UserID:   ownerID,
+		Role:     RoleOwner,
+		JoinedAt: now,
+	}}
+	for _, id := range memberIDs {
+		members = append(members, ConversationMember{
+			UserID:   id,
+			Role:     RoleMember,
+			JoinedAt: now,
+		})
+	}
+	conversation := Conversation{Name: name}
+	if err := cs.Create(&conversation, members); err != nil {
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+func (cs *conversationService) Rename(id, actorID uint, name string) (*Conversation, error) {
+	actor, err := cs.Member(id, actorID)
+	if err != nil {
+		return nil, err
+	}
+	if !actor.Role.manages(RoleMember) {
+		return nil, ErrConversationForbidden
+	}
+	conversation, err := cs.ByID(id)
+	if err != nil {
+		return nil, err
+	}
+	conversation.Name = name
+	if err := cs.Update(conversation); err != nil {
+		return nil, err
+	}
+	return conversation, nil
+}
+
+func (cs *conversationService) AddMembers(id, actorID uint, userIDs []uint) ([]ConversationMember, error) {
+	actor, err := cs.Member(id, actorID)
+	if err != nil {
+		return nil, err
+	}
+	if !actor.Role.manages(RoleMember) {
+		return nil, ErrConversationForbidden
+	}
+	userIDs = uniqueIDs(userIDs, actorID)
+	if len(userIDs) == 0 {
+		return nil, ErrConversationMembersRequired
+	}
+	members, err := cs.Members(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(members)+len(userIDs) > MaxConversationMembers {
+		return nil, ErrConversationTooLarge
+	}
+	for _, m := range members {
+		for _, uid := range userIDs {
+			if m.UserID == uid {
+				return nil, ErrConversationMemberExists
+			}
+		}
+	}
+	if err := cs.friendsOnly(actorID, userIDs); err != nil {
+		return nil, err
+	}
+
+	added := make([]ConversationMember, 0, len(userIDs))
+	now := time.Now()
+	for _, uid := range userIDs {
+		added = append(added, ConversationMember{
+			ConversationID: id,
+			UserID:         uid,
+			Role:           RoleMember,
+			JoinedAt:       now,
+		})
+	}
+	if err := cs.CreateMembers(added); err != nil {
+		return nil, err
+	}
+	return added, nil
+}
+
+func (cs *conversationService) RemoveMember(id, actorID, userID uint) error {
+	if actorID == userID {
+		return cs.Leave(id, userID)
+	}
+	actor, err := cs.Member(id, actorID)
+	if err != nil {
+		return err
+	}
+	target, err := cs.Member(id, userID)
+	if err != nil {
+		return err
+	}
+	if !actor.Role.manages(target.Role) {
+		return ErrConversationForbidden
+	}
+	return cs.DeleteMember(target.ID)
+}
+
+func (cs *conversationService) Leave(id, userID uint) error {
+	member, err := cs.Member(id, userID)
+	if err != nil {
+		return err
+	}
+	if member.Role == RoleOwner {
+		members, err := cs.Members(id)
+		if err != nil {
+			return err
+		}
+		if len(members) > 1 {
+			return ErrConversationOwnerLeaving
+		}
+		return cs.DeleteWithLastMember(id, member.ID)
+	}
+	return cs.DeleteMember(member.ID)
+}
+
+func (cs *conversationService) TransferOwnership(id, ownerID, newOwnerID uint) error {
+	owner, err := cs.Member(id, ownerID)
+	if err != nil {
+		return err
+	}
+	if owner.Role != RoleOwner {
+		return ErrConversationForbidden
+	}
+	if ownerID == newOwnerID {
+		return nil
+	}
+	next, err := cs.Member(id, newOwnerID)
+	if err != nil {
+		return err
+	}
+	return cs.HandOver(owner, next)
+}
+
+func (cs *conversationService) SetRole(id, actorID, userID uint, role ConversationRole) (*ConversationMember, error) {
+	if role != RoleAdmin && role != RoleMember {
+		return nil, ErrConversationRoleInvalid
+	}
+	actor, err := cs.Member(id, actorID)
+	if err != nil {
+		return nil, err
+	}
+	if actor.Role != RoleOwner {
+		return nil, ErrConversationForbidden
+	}
+	target, err := cs.Member(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if target.Role == RoleOwner {
+		return nil, ErrConversationOwnerRole
+	}
+	if target.Role == role {
+		return target, nil
+	}
+	target.Role = role
+	if err := cs.UpdateMember(target); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+func (cs *conversationService) SetMuted(id, userID uint, muted bool) (*ConversationMember, error) {
+	member, err := cs.Member(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if member.Muted == muted {
+		return member, nil
+	}
+	member.Muted = muted
+	if err := cs.UpdateMember(member); err != nil {
+		return nil, err
+	}
+	return member, nil
+}
+
+// friendsOnly returns ErrConversationNotFriends unless userID
+// may talk to every one of otherIDs. See canTalk.
+func (cs *conversationService) friendsOnly(userID uint, otherIDs []uint) error {
+	for _, id := range otherIDs {
+		switch err := canTalk(cs.friends, userID, id); err {
+		case nil:
+		case ErrNotFriends:
+			return ErrConversationNotFriends
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// uniqueIDs returns ids in order with duplicates, zeros and
+// exclude dropped.
+func uniqueIDs(ids []uint, exclude uint) []uint {
+	seen := map[uint]bool{0: true, exclude: true}
+	out := []uint{}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+func (cv *conversationValidator) ByID(id uint) (*Conversation, error) {
+	if id <= 0 {
+		return nil, ErrIDInvalid
+	}
+	return cv.ConversationDB.ByID(id)
+}
+
+func (cv *conversationValidator) Create(conversation *Conversation, members []ConversationMember) error {
+	err := runConversationValFuncs(conversation,
+		cv.normalizeName,
+		cv.nameRequired,
+		cv.nameMaxLength)
+	if err != nil {
+		return err
+	}
+	for i := range members {
+		err := runConversationMemberValFuncs(&members[i],
+			cv.userIDRequired,
+			cv.roleValid)
+		if err != nil {
+			return err
+		}
+	}
+	return cv.ConversationDB.Create(conversation, members)
+}
+
+func (cv *conversationValidator) Update(conversation *Conversation) error {
+	err := runConversationValFuncs(conversation,
+		cv.normalizeName,
+		cv.nameRequired,
+		cv.nameMaxLength)
+	if err != nil {
+		return err
+	}
+	return cv.ConversationDB.Update(conversation)
+}
+
+func (cv *conversationValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return cv.ConversationDB.Delete(id)
+}
+
+func (cv *conversationValidator) Member(conversationID, userID uint) (*ConversationMember, error) {
+	if conversationID <= 0 || userID <= 0 {
+		return nil, ErrNotFound
+	}
+	return cv.ConversationDB.Member(conversationID, userID)
+}
+
+func (cv *conversationValidator) CreateMembers(members []ConversationMember) error {
+	for i := range members {
+		err := runConversationMemberValFuncs(&members[i],
+			cv.conversationIDRequired,
+			cv.userIDRequired,
+			cv.roleValid)
+		if err != nil {
+			return err
+		}
+	}
+	return cv.ConversationDB.CreateMembers(members)
+}
+
+func (cv *conversationValidator) UpdateMember(member *ConversationMember) error {
+	err := runConversationMemberValFuncs(member,
+		cv.conversationIDRequired,
+		cv.userIDRequired,
+		cv.roleValid)
+	if err != nil {
+		return err
+	}
+	return cv.ConversationDB.UpdateMember(member)
+}
+
+func (cv *conversationValidator) DeleteMember(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return cv.ConversationDB.DeleteMember(id)
+}
+
+func (cv *conversationValidator) HandOver(owner, next *ConversationMember) error {
+	if owner.ID <= 0 || next.ID <= 0 || owner.ConversationID != next.ConversationID {
+		return ErrIDInvalid
+	}
+	return cv.ConversationDB.HandOver(owner, next)
+}
+
+func (cv *conversationValidator) DeleteWithLastMember(id, memberID uint) error {
+	if id <= 0 || memberID <= 0 {
+		return ErrIDInvalid
+	}
+	return cv.ConversationDB.DeleteWithLastMember(id, memberID)
+}
+
+func (cv *conversationValidator) normalizeName(c *Conversation) error {
+	c.Name = strings.TrimSpace(c.Name)
+	return nil
+}
+
+func (cv *conversationValidator) nameRequired(c *Conversation) error {
+	if c.Name == "" {
+		return ErrConversationNameRequired
+	}
+	return nil
+}
+
+func (cv *conversationValidator) nameMaxLength(c *Conversation) error {
+	if utf8.RuneCountInString(c.Name) > conversationNameMaxLength {
+		return ErrConversationNameTooLong
+	}
+	return nil
+}
+
+func (cv *conversationValidator) conversationIDRequired(m *ConversationMember) error {
+	if m.ConversationID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+func (cv *conversationValidator) userIDRequired(m *ConversationMember) error {
+	if m.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (cv *conversationValidator) roleValid(m *ConversationMember) error {
+	if !m.Role.Valid() {
+		return ErrConversationRoleInvalid
+	}
+	return nil
+}
+
+func (cg *conversationGorm) ByID(id uint) (*Conversation, error) {
+	var conversation Conversation
+	db := cg.db.Where("id = ?", id)
+	err := first(db, &conversation)
+	return &conversation, err
+}
+
+func (cg *conversationGorm) ByUserID(userID uint) ([]Conversation, error) {
+	var conversations []Conversation
+	err := cg.db.
+		Joins("JOIN conversation_members ON conversation_members.conversation_id = conversations.id "+
+			"AND conversation_members.deleted_at IS NULL").
+		Where("conversation_members.user_id = ?", userID).
+		Order("conversations.id desc").
+		Find(&conversations).Error
+	return conversations, err
+}
+
+func (cg *conversationGorm) Create(conversation *Conversation, members []ConversationMember) error {
+	return cg.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(conversation).Error; err != nil {
+			return err
+		}
+		for i := range members {
+			members[i].ConversationID = conversation.ID
+			if err := tx.Create(&members[i]).Error; err != nil {
+				return memberConstraintError(err)
+			}
+		}
+		return nil
+	})
+}
+
+func (cg *conversationGorm) Update(conversation *Conversation) error {
+	return cg.db.Save(conversation).Error
+}
+
+func (cg *conversationGorm) Delete(id uint) error {
+	conversation := Conversation{Model: gorm.Model{ID: id}}
+	return cg.db.Delete(&conversation).Error
+}
+
+func (cg *conversationGorm) Members(conversationID uint) ([]ConversationMember, error) {
+	var members []ConversationMember
+	err := cg.db.Where("conversation_id = ?", conversationID).
+		Order("id").
+		Find(&members).Error
+	return members, err
+}
+
+func (cg *conversationGorm) Member(conversationID, userID uint) (*ConversationMember, error) {
+	var member ConversationMember
+	db := cg.db.Where("conversation_id = ? AND user_id = ?", conversationID, userID)
+	err := first(db, &member)
+	return &member, err
+}
+
+func (cg *conversationGorm) CreateMembers(members []ConversationMember) error {
+	return cg.db.Transaction(func(tx *gorm.DB) error {
+		for i := range members {
+			if err := tx.Create(&members[i]).Error; err != nil {
+				return memberConstraintError(err)
+			}
+		}
+		return nil
+	})
+}
+
+func (cg *conversationGorm) UpdateMember(member *ConversationMember) error {
+	return memberConstraintError(cg.db.Save(member).Error)
+}
+
+func (cg *conversationGorm) DeleteMember(id uint) error {
+	member := ConversationMember{Model: gorm.Model{ID: id}}
+	return cg.db.Delete(&member).Error
+}
+
+// HandOver only demotes owner while the row still says owner,
+// so two racing transfers cannot both succeed.
+func (cg *conversationGorm) HandOver(owner, next *ConversationMember) error {
+	return cg.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&ConversationMember{}).
+			Where("id = ? AND role = ?", owner.ID, RoleOwner).
+			Update("role", RoleAdmin)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrConversationForbidden
+		}
+		res = tx.Model(&ConversationMember{}).
+			Where("id = ? AND conversation_id = ?", next.ID, owner.ConversationID).
+			Update("role", RoleOwner)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		owner.Role, next.Role = RoleAdmin, RoleOwner
+		return nil
+	})
+}
+
+func (cg *conversationGorm) DeleteWithLastMember(id, memberID uint) error {
+	return cg.db.Transaction(func(tx *gorm.DB) error {
+		var others int
+		err := tx.Model(&ConversationMember{}).
+			Where("conversation_id = ? AND id <> ?", id, memberID).
+			Count(&others).Error
+		if err != nil {
+			return err
+		}
+		if others > 0 {
+			return ErrConversationOwnerLeaving
+		}
+		member := ConversationMember{Model: gorm.Model{ID: memberID}}
+		if err := tx.Delete(&member).Error; err != nil {
+			return err
+		}
+		conversation := Conversation{Model: gorm.Model{ID: id}}
+		return tx.Delete(&conversation).Error
+	})
+}
+
+// memberConstraintError turns a violation of the unique index
+// on conversation_members into the error it means to a user.
+func memberConstraintError(err error) error {
+	if violated(err) == constraintUnique {
+		return ErrConversationMemberExists
+	}
+	return err
+}
@@ -0,0 +1,189 @@
+package models
+
+import "testing"
+
+// testGroup is a group with one user in each role, plus a
+// friend of the owner outside the group and a stranger.
+type testGroup struct {
+	name                         string
+	id                           uint
+	owner, admin, admin2, member uint
+	friend, stranger             uint
+	conversations                ConversationService
+	db                           ConversationDB
+}
+
+func newTestGroups(t *testing.T) []testGroup {
+	var groups []testGroup
+	for _, store := range testStores(t) {
+		cdb := ConversationDB(NewMemoryConversationDB())
+		if store.name == "sqlite" {
+			cdb = &conversationGorm{store.friends.(*friendGorm).db}
+		}
+		var ids []uint
+		for _, handle := range []string{"owner", "admin", "admin2", "member", "friend", "stranger"} {
+			ids = append(ids, mustCreateUser(t, store.users, handle+"@example.com", handle).ID)
+		}
+		g := testGroup{
+			name:  store.name,
+			owner: ids[0], admin: ids[1], admin2: ids[2], member: ids[3],
+			friend: ids[4], stranger: ids[5],
+			conversations: newConversationService(cdb, store.friends),
+			db:            cdb,
+		}
+		for _, id := range []uint{g.admin, g.admin2, g.member, g.friend} {
+			f := Friend{UserID: g.owner, FriendID: id, Status: FriendAccepted}
+			if err := store.friends.Create(&f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		c, err := g.conversations.Start(g.owner, "group", []uint{g.admin, g.admin2, g.member})
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.id = c.ID
+		for _, id := range []uint{g.admin, g.admin2} {
+			if _, err := g.conversations.SetRole(g.id, g.owner, id, RoleAdmin); err != nil {
+				t.Fatal(err)
+			}
+		}
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+func TestConversationPermissions(t *testing.T) {
+	for _, g := range newTestGroups(t) {
+		t.Run(g.name, func(t *testing.T) {
+			cs := g.conversations
+			tests := []struct {
+				name string
+				fn   func() error
+				want error
+			}{
+				{"admin removes admin", func() error { return cs.RemoveMember(g.id, g.admin, g.admin2) }, ErrConversationForbidden},
+				{"admin removes owner", func() error { return cs.RemoveMember(g.id, g.admin, g.owner) }, ErrConversationForbidden},
+				{"member removes member", func() error { return cs.RemoveMember(g.id, g.member, g.admin) }, ErrConversationForbidden},
+				{"admin sets role", func() error {
+					_, err := cs.SetRole(g.id, g.admin, g.member, RoleAdmin)
+					return err
+				}, ErrConversationForbidden},
+				{"member sets role", func() error {
+					_, err := cs.SetRole(g.id, g.member, g.member, RoleAdmin)
+					return err
+				}, ErrConversationForbidden},
+				{"owner sets own role", func() error {
+					_, err := cs.SetRole(g.id, g.owner, g.owner, RoleAdmin)
+					return err
+				}, ErrConversationOwnerRole},
+				{"admin transfers", func() error { return cs.TransferOwnership(g.id, g.admin, g.admin2) }, ErrConversationForbidden},
+				{"owner leaves non-empty group", func() error { return cs.Leave(g.id, g.owner) }, ErrConversationOwnerLeaving},
+				{"member adds", func() error {
+					_, err := cs.AddMembers(g.id, g.member, []uint{g.friend})
+					return err
+				}, ErrConversationForbidden},
+				{"owner adds non-friend", func() error {
+					_, err := cs.AddMembers(g.id, g.owner, []uint{g.friend, g.stranger})
+					return err
+				}, ErrConversationNotFriends},
+				{"non-member renames", func() error {
+					_, err := cs.Rename(g.id, g.stranger, "mine")
+					return err
+				}, ErrNotFound},
+				{"non-member adds", func() error {
+					_, err := cs.AddMembers(g.id, g.stranger, []uint{g.owner})
+					return err
+				}, ErrNotFound},
+				{"non-member removes", func() error { return cs.RemoveMember(g.id, g.stranger, g.member) }, ErrNotFound},
+				{"non-member leaves", func() error { return cs.Leave(g.id, g.stranger) }, ErrNotFound},
+				{"non-member transfers", func() error { return cs.TransferOwnership(g.id, g.stranger, g.owner) }, ErrNotFound},
+				{"transfer to non-member", func() error { return cs.TransferOwnership(g.id, g.owner, g.stranger) }, ErrNotFound},
+			}
+			for _, tt := range tests {
+				if err := tt.fn(); err != tt.want {
+					t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+				}
+			}
+			if _, err := cs.Member(g.id, g.friend); err != ErrNotFound {
+				t.Errorf("friend added alongside a non-friend: err = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestConversationMembership(t *testing.T) {
+	for _, g := range newTestGroups(t) {
+		t.Run(g.name, func(t *testing.T) {
+			cs := g.conversations
+
+			// A batch with a clash leaves nobody behind.
+			batch := []ConversationMember{
+				{ConversationID: g.id, UserID: g.friend, Role: RoleMember},
+				{ConversationID: g.id, UserID: g.member, Role: RoleMember},
+			}
+			if err := g.db.CreateMembers(batch); err != ErrConversationMemberExists {
+				t.Errorf("CreateMembers with a clash: err = %v, want ErrConversationMemberExists", err)
+			}
+			if _, err := cs.Member(g.id, g.friend); err != ErrNotFound {
+				t.Errorf("friend after failed batch: err = %v, want ErrNotFound", err)
+			}
+			if _, err := cs.AddMembers(g.id, g.admin, []uint{g.friend}); err != ErrConversationNotFriends {
+				t.Errorf("admin adds owner's friend: err = %v, want ErrConversationNotFriends", err)
+			}
+			if _, err := cs.AddMembers(g.id, g.owner, []uint{g.friend}); err != nil {
+				t.Fatal(err)
+			}
+			if err := cs.RemoveMember(g.id, g.admin, g.friend); err != nil {
+				t.Errorf("admin removes member: err = %v, want nil", err)
+			}
+
+			stale, err := cs.Member(g.id, g.owner)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cs.TransferOwnership(g.id, g.owner, g.member); err != nil {
+				t.Fatal(err)
+			}
+			// A transfer that read the old owner before this one
+			// committed must not go through.
+			heir, err := cs.Member(g.id, g.admin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := g.db.HandOver(stale, heir); err != ErrConversationForbidden {
+				t.Errorf("HandOver from a stale owner: err = %v, want ErrConversationForbidden", err)
+			}
+			owners := 0
+			members, err := cs.Members(g.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range members {
+				if m.Role == RoleOwner {
+					owners++
+				}
+				if m.UserID == g.owner && m.Role != RoleAdmin {
+					t.Errorf("old owner role = %s, want admin", m.Role)
+				}
+			}
+			if owners != 1 {
+				t.Errorf("%d owners after transfer, want 1", owners)
+			}
+			if err := cs.TransferOwnership(g.id, g.owner, g.admin); err != ErrConversationForbidden {
+				t.Errorf("old owner transfers again: err = %v, want ErrConversationForbidden", err)
+			}
+
+			for _, id := range []uint{g.owner, g.admin, g.admin2} {
+				if err := cs.RemoveMember(g.id, g.member, id); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := cs.Leave(g.id, g.member); err != nil {
+				t.Fatalf("last member leaves: %v", err)
+			}
+			if _, err := cs.ByID(g.id); err != ErrNotFound {
+				t.Errorf("group after last member left: err = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
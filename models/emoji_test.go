@@ -0,0 +1,41 @@
+package models
+
+import "testing"
+
+func TestValidEmoji(t *testing.T) {
+	tests := []struct {
+		name  string
+		emoji string
+		want  bool
+	}{
+		{"simple", "👍", true},
+		{"skin tone", "👍🏽", true},
+		{"presentation selector", "❤️", true},
+		{"misc symbol", "☀", true},
+		{"dingbat", "✂️", true},
+		{"zwj family", "👨‍👩‍👧‍👦", true},
+		{"zwj with selector", "🏳️‍⚧️", true},
+		{"keycap", "1️⃣", true},
+		{"keycap without selector", "#⃣", true},
+		{"flag", "🇬🇧", true},
+		{"subdivision flag", "🏴󠁧󠁢󠁥󠁮󠁧󠁿", true},
+
+		{"empty", "", false},
+		{"letter", "a", false},
+		{"bare digit", "1", false},
+		{"lone dingbat", "✁", false},
+		{"circled digit", "❶", false},
+		{"arrow dingbat", "➔", false},
+		{"chess piece", "♔", false},
+		{"two emoji", "👍👍", false},
+		{"half a flag", "🇬", false},
+		{"trailing zwj", "👍‍", false},
+		{"trailing space", "👍 ", false},
+		{"unterminated tags", "🏴󠁧󠁢", false},
+	}
+	for _, tt := range tests {
+		if got := validEmoji(tt.emoji); got != tt.want {
+			t.Errorf("%s: validEmoji(%q) = %v, want %v", tt.name, tt.emoji, got, tt.want)
+		}
+	}
+}
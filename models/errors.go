@@ -1,6 +1,11 @@
 package models
 
-import "strings"
+import (
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
 
 const (
 	// ErrNotFound is returned when a resource cannot be found
@@ -24,12 +29,128 @@ const (
 	// ErrPasswordTooShort is returned when an update or create is
 	// attempted with a user password that is less than 8 characters.
 	ErrPasswordTooShort modelError = "models: password must be at least 8 characters long"
+	// ErrHandleInvalid is returned when a handle has the wrong
+	// length or characters outside of a-z, 0-9 and _.
+	ErrHandleInvalid modelError = "models: handle must be 3 to 20 letters, numbers or underscores"
+	// ErrHandleReserved is returned when a handle is one we
+	// keep for ourselves.
+	ErrHandleReserved modelError = "models: that handle is reserved"
+	// ErrHandleTaken is returned when an update or create is
+	// attempted with a handle that is already in use.
+	ErrHandleTaken      modelError = "models: handle is already taken"
 	ErrFriendIDRequired modelError = "models: friend ID is required"
-	ErrTokenInvalid     modelError = "models: token provided is not valid"
+	// ErrFriendQueryRequired is returned when a friend request
+	// does not say who it is for.
+	ErrFriendQueryRequired modelError = "models: an email address or handle is required"
+	// ErrFriendUserNotFound is returned when no user matches
+	// the email address or handle in a friend request.
+	ErrFriendUserNotFound modelError = "models: no user found with that email address or handle"
+	// ErrFriendSelf is returned when a user sends a friend
+	// request to themselves.
+	ErrFriendSelf modelError = "models: you cannot add yourself as a friend"
+	// ErrFriendRequestExists is returned when a friend request
+	// or friendship between two users already exists.
+	ErrFriendRequestExists modelError = "models: a friend request already exists for that user"
+	// ErrFriendStatusInvalid is returned when a Friend is saved
+	// with a status that is not one of the FriendStatus values.
+	ErrFriendStatusInvalid modelError = "models: friend status is not valid"
+	// ErrFriendDirectionInvalid is returned when friends are
+	// listed in a direction other than incoming or outgoing.
+	ErrFriendDirectionInvalid modelError = "models: direction must be incoming or outgoing"
+	// ErrFriendNotAddressee is returned when the sender of a
+	// friend request tries to accept or decline it.
+	ErrFriendNotAddressee modelError = "models: only the recipient of a friend request can respond to it"
+	// ErrFriendNotPending is returned when accepting or
+	// declining a request that has already been answered.
+	ErrFriendNotPending modelError = "models: friend request has already been answered"
+	// ErrBlockSelf is returned when a user tries to block
+	// themselves.
+	ErrBlockSelf modelError = "models: you cannot block yourself"
+	// ErrUserBlocked is returned when a user sends a friend
+	// request to someone they have blocked.
+	ErrUserBlocked  modelError = "models: you have blocked that user, unblock them first"
+	ErrTokenInvalid modelError = "models: token provided is not valid"
+	// ErrTokenExpired is returned when a refresh token is used
+	// after it has expired.
+	ErrTokenExpired modelError = "models: token has expired, please log in again"
+	// ErrTokenReused is returned when a refresh token that was
+	// already exchanged is presented again. The session it
+	// belonged to is revoked when this happens.
+	ErrTokenReused modelError = "models: token has already been used, please log in again"
+	// ErrRecipientRequired is returned when a message is sent
+	// without saying who it is for.
+	ErrRecipientRequired modelError = "models: recipient is required"
+	// ErrMessageSelf is returned when a user tries to send a
+	// message to themselves.
+	ErrMessageSelf modelError = "models: you cannot send a message to yourself"
+	// ErrBodyRequired is returned when a message is empty or
+	// only whitespace.
+	ErrBodyRequired modelError = "models: message body is required"
+	// ErrBodyTooLong is returned when a message body is longer
+	// than messageMaxLength characters.
+	ErrBodyTooLong modelError = "models: message body must be 4000 characters or fewer"
+	// ErrNotFriends is returned when a message is sent to a
+	// user who has not accepted a friend request.
+	ErrNotFriends modelError = "models: you can only message accepted friends"
+	// ErrMessageTarget is returned when a message is addressed
+	// to both a user and a group.
+	ErrMessageTarget modelError = "models: a message can go to a user or a group, not both"
+	// ErrMessageNotSender is returned when someone other than
+	// its sender tries to edit or delete a message.
+	ErrMessageNotSender modelError = "models: you can only change messages you sent"
+	// ErrMessageEditWindow is returned when a message is
+	// edited or deleted after the edit window has passed.
+	ErrMessageEditWindow modelError = "models: that message is too old to change"
+	// ErrParentNotFound is returned when a reply is sent to a
+	// message that is deleted or in another conversation.
+	ErrParentNotFound modelError = "models: the message you are replying to could not be found"
+	// ErrEmojiInvalid is returned when a reaction is anything
+	// but a single emoji.
+	ErrEmojiInvalid modelError = "models: reaction must be a single emoji"
+	// ErrReactionExists is returned when a user reacts to a
+	// message with an emoji they already reacted with.
+	ErrReactionExists modelError = "models: you already reacted with that emoji"
+	// ErrConversationNameRequired is returned when a group is
+	// created or renamed without a name.
+	ErrConversationNameRequired modelError = "models: group name is required"
+	// ErrConversationNameTooLong is returned when a group name
+	// is longer than conversationNameMaxLength characters.
+	ErrConversationNameTooLong modelError = "models: group name must be 100 characters or fewer"
+	// ErrConversationMembersRequired is returned when a group
+	// is created, or members are added, without anyone new.
+	ErrConversationMembersRequired modelError = "models: at least one other member is required"
+	// ErrConversationTooLarge is returned when a group would
+	// have more than MaxConversationMembers members.
+	ErrConversationTooLarge modelError = "models: a group can have at most 100 members"
+	// ErrConversationNotFriends is returned when a user tries
+	// to put someone other than an accepted friend in a group.
+	ErrConversationNotFriends modelError = "models: you can only add accepted friends to a group"
+	// ErrConversationForbidden is returned when a member tries
+	// something their role does not allow.
+	ErrConversationForbidden modelError = "models: you don't have permission to do that in this group"
+	// ErrConversationMemberExists is returned when adding
+	// someone who is already in the group.
+	ErrConversationMemberExists modelError = "models: that user is already in the group"
+	// ErrConversationOwnerLeaving is returned when the owner
+	// tries to leave a group that still has other members.
+	ErrConversationOwnerLeaving modelError = "models: transfer ownership of the group before leaving it"
+	// ErrConversationOwnerRole is returned when the owner's
+	// role is changed other than by transferring ownership.
+	ErrConversationOwnerRole modelError = "models: the owner's role can only change by transferring ownership"
+	// ErrConversationRoleInvalid is returned when a member is
+	// given a role that is not one of the ConversationRoles.
+	ErrConversationRoleInvalid modelError = "models: role must be admin or member"
 	// ErrIDInvalid is returned when an invalid ID is provided
 	// to a method like Delete.
 	ErrIDInvalid      privateError = "models: ID provided was invalid"
 	ErrUserIDRequired privateError = "models: user ID is required"
+	// ErrDuplicate is returned by the UserDBs, SaveReadCursor
+	// and the in-memory stores when a row would break a unique
+	// index.
+	ErrDuplicate privateError = "models: record violates a unique index"
+	// ErrSocketClosed is returned when sending on or connecting
+	// to a SocketService that has been closed.
+	ErrSocketClosed privateError = "models: socket service is closed"
 )
 
 type modelError string
@@ -50,3 +171,40 @@ type privateError string
 func (e privateError) Error() string {
 	return string(e)
 }
+
+// constraint names the kind of database constraint an error
+// reports a violation of, or is empty for any other error.
+type constraint string
+
+const (
+	constraintUnique     constraint = "unique"
+	constraintCheck      constraint = "check"
+	constraintForeignKey constraint = "foreign_key"
+)
+
+// violated reports which constraint err broke, so that the gorm
+// layers can turn those errors into modelErrors. Postgres and
+// SQLite both report violations with their own error types.
+func violated(err error) constraint {
+	switch e := err.(type) {
+	case *pq.Error:
+		switch e.Code.Name() {
+		case "unique_violation":
+			return constraintUnique
+		case "check_violation":
+			return constraintCheck
+		case "foreign_key_violation":
+			return constraintForeignKey
+		}
+	case sqlite3.Error:
+		switch e.ExtendedCode {
+		case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+			return constraintUnique
+		case sqlite3.ErrConstraintCheck:
+			return constraintCheck
+		case sqlite3.ErrConstraintForeignKey:
+			return constraintForeignKey
+		}
+	}
+	return ""
+}
@@ -1,30 +1,142 @@
 package models
 
 import (
+	"strings"
+
 	"github.com/jinzhu/gorm"
 )
 
+// FriendStatus is the state of a Friend row. A row is created
+// as FriendPending by the requester (UserID) and answered by
+// the addressee (FriendID).
+type FriendStatus string
+
+const (
+	FriendPending  FriendStatus = "pending"
+	FriendAccepted FriendStatus = "accepted"
+	FriendDeclined FriendStatus = "declined"
+	FriendBlocked  FriendStatus = "blocked"
+)
+
+// Valid reports whether s is one of the known statuses.
+func (s FriendStatus) Valid() bool {
+	switch s {
+	case FriendPending, FriendAccepted, FriendDeclined, FriendBlocked:
+		return true
+	}
+	return false
+}
+
+// FriendDirection says which side of a Friend row a user is
+// on. Outgoing rows are requests they sent (they are UserID);
+// incoming rows are requests sent to them (they are FriendID).
+type FriendDirection string
+
+const (
+	FriendOutgoing FriendDirection = "outgoing"
+	FriendIncoming FriendDirection = "incoming"
+)
+
+const (
+	// DefaultFriendLimit is how many rows a friend listing
+	// holds when the caller does not ask for a size.
+	DefaultFriendLimit = 50
+	// MaxFriendLimit caps the size of a friend listing page.
+	MaxFriendLimit = 100
+)
+
+// FriendQuery selects a page of the rows on one side of
+// UserID's relationships, newest first. An empty Status
+// matches every status except FriendBlocked, which has to be
+// asked for. Blocks are never listed as incoming so nobody can
+// find out who blocked them. If Before is non-zero only rows
+// with a smaller ID are returned, which is how callers page.
+type FriendQuery struct {
+	UserID    uint
+	Direction FriendDirection
+	Status    FriendStatus
+	Before    uint
+	Limit     int
+}
+
+// PageSize is how many rows the query returns at most once
+// the defaults and caps are applied to Limit.
+func (q FriendQuery) PageSize() int {
+	switch {
+	case q.Limit <= 0:
+		return DefaultFriendLimit
+	case q.Limit > MaxFriendLimit:
+		return MaxFriendLimit
+	}
+	return q.Limit
+}
+
+// Friend rows reference users on both sides. The database
+// allows at most one live row per (UserID, FriendID) and none
+// from a user to themselves.
 type Friend struct {
 	gorm.Model
-	UserID   uint   `gorm:"not_null;index"`
-	FriendID uint   `gorm:"not_null"`
-	Status   string `gorm:"not_null"`
+	UserID   uint         `gorm:"not null;index"`
+	FriendID uint         `gorm:"not null;index"`
+	Status   FriendStatus `gorm:"not null"`
 }
 
 type FriendService interface {
+	// Request sends a friend request from userID to the user
+	// identified by query, which is an email address or a
+	// handle. If that user already sent userID a pending
+	// request it is accepted instead. A request of userID's
+	// that was declined is replaced by a new pending one, so
+	// declining does not stop someone asking again.
+	Request(userID uint, query string) (*Friend, error)
+	// BlockedByIDs returns the IDs of every user who has
+	// blocked userID.
+	BlockedByIDs(userID uint) ([]uint, error)
+	// Accept marks the pending request id as accepted on behalf
+	// of userID, who must be its addressee, and creates the
+	// reverse row so that both users see each other.
+	Accept(id, userID uint) (*Friend, error)
+	// Decline marks the pending request id as declined on
+	// behalf of userID, who must be its addressee.
+	Decline(id, userID uint) (*Friend, error)
+	// Block stops targetID from reaching userID: they can no
+	// longer send userID friend requests or messages, or find
+	// them in search. Any relationship between the two is
+	// severed. Blocking someone twice is not an error.
+	Block(userID, targetID uint) (*Friend, error)
+	// Unblock lifts a block userID placed on targetID. It
+	// does not bring back the relationship the block severed.
+	Unblock(userID, targetID uint) error
+	// Unfriend removes the relationship id in both directions.
+	// Either side may unfriend, and a requester may use it to
+	// cancel a request that is still pending.
+	Unfriend(id, userID uint) error
 	FriendDB
 }
 
 type FriendDB interface {
 	ByID(id uint) (*Friend, error)
 	ByUserID(userID uint) ([]Friend, error)
+	// ByFriendID returns the rows where friendID is the
+	// addressee, i.e. requests other users sent to friendID.
+	ByFriendID(friendID uint) ([]Friend, error)
+	// ByUserAndFriendID looks up the row created when userID
+	// sent a request to friendID. It does not look at the
+	// reverse direction.
+	ByUserAndFriendID(userID, friendID uint) (*Friend, error)
+	// Find returns the rows matching query. See FriendQuery.
+	Find(query FriendQuery) ([]Friend, error)
 	Create(friend *Friend) error
 	Update(friend *Friend) error
 	Delete(id uint) error
+	// SaveBlock creates or updates block and deletes the row
+	// severID, if it is not zero, all or nothing.
+	SaveBlock(block *Friend, severID uint) error
 }
 
 type friendService struct {
 	FriendDB
+	users UserDB
 }
 
 type friendValidator struct {
@@ -46,16 +158,308 @@ func runFriendValFuncs(friend *Friend, fns ...friendValFunc) error {
 	return nil
 }
 
-func NewFriendService(db *gorm.DB) FriendService {
+// NewFriendService needs the UserDB to resolve who a friend
+// request is addressed to.
+func NewFriendService(db *gorm.DB, users UserDB) FriendService {
+	return newFriendService(&friendGorm{db}, users)
+}
+
+func newFriendService(fdb FriendDB, users UserDB) FriendService {
 	return &friendService{
-		FriendDB: &friendValidator{&friendGorm{db}},
+		FriendDB: &friendValidator{fdb},
+		users:    users,
+	}
+}
+
+func (fs *friendService) Request(userID uint, query string) (*Friend, error) {
+	target, err := fs.lookup(query)
+	if err != nil {
+		return nil, err
+	}
+	if target.ID == userID {
+		return nil, ErrFriendSelf
+	}
+
+	theirs, err := fs.ByUserAndFriendID(target.ID, userID)
+	switch err {
+	case nil:
+		switch theirs.Status {
+		case FriendPending:
+			return fs.Accept(theirs.ID, userID)
+		case FriendAccepted:
+			return nil, ErrFriendRequestExists
+		case FriendBlocked:
+			// Don't let on that they blocked us.
+			return nil, ErrFriendUserNotFound
+		}
+	case ErrNotFound:
+	default:
+		return nil, err
+	}
+
+	ours, err := fs.ByUserAndFriendID(userID, target.ID)
+	switch err {
+	case nil:
+		switch ours.Status {
+		case FriendBlocked:
+			return nil, ErrUserBlocked
+		case FriendDeclined:
+			if err := fs.Delete(ours.ID); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, ErrFriendRequestExists
+		}
+	case ErrNotFound:
+	default:
+		return nil, err
+	}
+
+	friend := Friend{
+		UserID:   userID,
+		FriendID: target.ID,
+		Status:   FriendPending,
+	}
+	if err := fs.Create(&friend); err != nil {
+		return nil, err
+	}
+	return &friend, nil
+}
+
+func (fs *friendService) BlockedByIDs(userID uint) ([]uint, error) {
+	incoming, err := fs.ByFriendID(userID)
+	if err != nil {
+		return nil, err
 	}
+	ids := []uint{}
+	for _, f := range incoming {
+		if f.Status == FriendBlocked {
+			ids = append(ids, f.UserID)
+		}
+	}
+	return ids, nil
+}
+
+func (fs *friendService) Block(userID, targetID uint) (*Friend, error) {
+	if userID == targetID {
+		return nil, ErrBlockSelf
+	}
+	if _, err := fs.users.ByID(targetID); err != nil {
+		return nil, err
+	}
+
+	// Their side of the relationship goes away, unless it is a
+	// block of their own.
+	var severID uint
+	theirs, err := fs.ByUserAndFriendID(targetID, userID)
+	switch err {
+	case nil:
+		if theirs.Status != FriendBlocked {
+			severID = theirs.ID
+		}
+	case ErrNotFound:
+	default:
+		return nil, err
+	}
+
+	// Our side becomes the block.
+	ours, err := fs.ByUserAndFriendID(userID, targetID)
+	switch err {
+	case nil:
+		if ours.Status == FriendBlocked && severID == 0 {
+			return ours, nil
+		}
+		ours.Status = FriendBlocked
+	case ErrNotFound:
+		ours = &Friend{
+			UserID:   userID,
+			FriendID: targetID,
+			Status:   FriendBlocked,
+		}
+	default:
+		return nil, err
+	}
+	if err := fs.SaveBlock(ours, severID); err != nil {
+		return nil, err
+	}
+	return ours, nil
+}
+
+func (fs *friendService) Unblock(userID, targetID uint) error {
+	block, err := fs.ByUserAndFriendID(userID, targetID)
+	if err != nil {
+		return err
+	}
+	if block.Status != FriendBlocked {
+		return ErrNotFound
+	}
+	return fs.Delete(block.ID)
+}
+
+// blockedEitherWay reports whether there is a block between
+// the two users in either direction.
+func blockedEitherWay(friends FriendDB, userID, otherID uint) (bool, error) {
+	for _, pair := range [][2]uint{
+		{userID, otherID},
+		{otherID, userID},
+	} {
+		friend, err := friends.ByUserAndFriendID(pair[0], pair[1])
+		switch err {
+		case nil:
+			if friend.Status == FriendBlocked {
+				return true, nil
+			}
+		case ErrNotFound:
+		default:
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// lookup resolves a friend request query to a user. Anything
+// with an @ past the first character is treated as an email
+// address, anything else as a handle. Display names are not
+// unique, so they are never used to pick someone.
+func (fs *friendService) lookup(query string) (*User, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, ErrFriendQueryRequired
+	}
+	var user *User
+	var err error
+	if strings.Contains(query[1:], "@") {
+		user, err = fs.users.ByEmail(query)
+	} else {
+		user, err = fs.users.ByHandle(query)
+	}
+	if err == ErrNotFound {
+		return nil, ErrFriendUserNotFound
+	}
+	return user, err
+}
+
+func (fs *friendService) Accept(id, userID uint) (*Friend, error) {
+	friend, err := fs.pendingFor(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	friend.Status = FriendAccepted
+	if err := fs.Update(friend); err != nil {
+		return nil, err
+	}
+
+	reverse, err := fs.ByUserAndFriendID(friend.FriendID, friend.UserID)
+	switch err {
+	case nil:
+		if reverse.Status == FriendBlocked {
+			return friend, nil
+		}
+		reverse.Status = FriendAccepted
+		err = fs.Update(reverse)
+	case ErrNotFound:
+		err = fs.Create(&Friend{
+			UserID:   friend.FriendID,
+			FriendID: friend.UserID,
+			Status:   FriendAccepted,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return friend, nil
+}
+
+func (fs *friendService) Decline(id, userID uint) (*Friend, error) {
+	friend, err := fs.pendingFor(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	friend.Status = FriendDeclined
+	if err := fs.Update(friend); err != nil {
+		return nil, err
+	}
+	return friend, nil
+}
+
+func (fs *friendService) Unfriend(id, userID uint) error {
+	friend, err := fs.ByID(id)
+	if err != nil {
+		return err
+	}
+	// Blocks are not relationships the other side can undo, so
+	// treat them as if they were not there.
+	if friend.Status == FriendBlocked ||
+		(friend.UserID != userID && friend.FriendID != userID) {
+		return ErrNotFound
+	}
+	if err := fs.Delete(friend.ID); err != nil {
+		return err
+	}
+
+	reverse, err := fs.ByUserAndFriendID(friend.FriendID, friend.UserID)
+	switch err {
+	case nil:
+		if reverse.Status == FriendBlocked {
+			return nil
+		}
+		return fs.Delete(reverse.ID)
+	case ErrNotFound:
+		return nil
+	default:
+		return err
+	}
+}
+
+// pendingFor looks up the request id and checks that it is
+// still pending and addressed to userID.
+func (fs *friendService) pendingFor(id, userID uint) (*Friend, error) {
+	friend, err := fs.ByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if friend.FriendID != userID {
+		if friend.UserID == userID {
+			return nil, ErrFriendNotAddressee
+		}
+		return nil, ErrNotFound
+	}
+	if friend.Status != FriendPending {
+		return nil, ErrFriendNotPending
+	}
+	return friend, nil
+}
+
+// Find checks the query and fills in its defaults.
+func (fv *friendValidator) Find(query FriendQuery) ([]Friend, error) {
+	if query.UserID <= 0 {
+		return nil, ErrUserIDRequired
+	}
+	switch query.Direction {
+	case "":
+		query.Direction = FriendOutgoing
+	case FriendOutgoing:
+	case FriendIncoming:
+		if query.Status == FriendBlocked {
+			return []Friend{}, nil
+		}
+	default:
+		return nil, ErrFriendDirectionInvalid
+	}
+	if query.Status != "" && !query.Status.Valid() {
+		return nil, ErrFriendStatusInvalid
+	}
+	query.Limit = query.PageSize()
+	return fv.FriendDB.Find(query)
 }
 
 func (fv *friendValidator) Create(friend *Friend) error {
 	err := runFriendValFuncs(friend,
 		fv.userIDRequired,
-		fv.friendIDRequired)
+		fv.friendIDRequired,
+		fv.notSelf,
+		fv.defaultStatus,
+		fv.statusValid)
 	if err != nil {
 		return err
 	}
@@ -65,7 +469,8 @@ func (fv *friendValidator) Create(friend *Friend) error {
 func (fv *friendValidator) Update(friend *Friend) error {
 	err := runFriendValFuncs(friend,
 		fv.userIDRequired,
-		fv.friendIDRequired)
+		fv.friendIDRequired,
+		fv.statusValid)
 	if err != nil {
 		return err
 	}
@@ -79,6 +484,18 @@ func (fv *friendValidator) Delete(id uint) error {
 	return fv.FriendDB.Delete(id)
 }
 
+func (fv *friendValidator) SaveBlock(block *Friend, severID uint) error {
+	err := runFriendValFuncs(block,
+		fv.userIDRequired,
+		fv.friendIDRequired,
+		fv.notSelf,
+		fv.statusValid)
+	if err != nil {
+		return err
+	}
+	return fv.FriendDB.SaveBlock(block, severID)
+}
+
 func (fv *friendValidator) userIDRequired(f *Friend) error {
 	if f.UserID <= 0 {
 		return ErrUserIDRequired
@@ -93,6 +510,27 @@ func (fv *friendValidator) friendIDRequired(f *Friend) error {
 	return nil
 }
 
+func (fv *friendValidator) notSelf(f *Friend) error {
+	if f.UserID == f.FriendID {
+		return ErrFriendSelf
+	}
+	return nil
+}
+
+func (fv *friendValidator) defaultStatus(f *Friend) error {
+	if f.Status == "" {
+		f.Status = FriendPending
+	}
+	return nil
+}
+
+func (fv *friendValidator) statusValid(f *Friend) error {
+	if !f.Status.Valid() {
+		return ErrFriendStatusInvalid
+	}
+	return nil
+}
+
 func (fg *friendGorm) ByID(id uint) (*Friend, error) {
 	var friend Friend
 	db := fg.db.Where("id = ?", id)
@@ -109,15 +547,81 @@ func (fg *friendGorm) ByUserID(userID uint) ([]Friend, error) {
 	return friends, nil
 }
 
+func (fg *friendGorm) ByFriendID(friendID uint) ([]Friend, error) {
+	var friends []Friend
+	err := fg.db.Where("friend_id = ?", friendID).Find(&friends).Error
+	if err != nil {
+		return nil, err
+	}
+	return friends, nil
+}
+
+func (fg *friendGorm) ByUserAndFriendID(userID, friendID uint) (*Friend, error) {
+	var friend Friend
+	db := fg.db.Where("user_id = ? AND friend_id = ?", userID, friendID)
+	err := first(db, &friend)
+	return &friend, err
+}
+
+func (fg *friendGorm) Find(query FriendQuery) ([]Friend, error) {
+	var friends []Friend
+	db := fg.db
+	if query.Direction == FriendIncoming {
+		db = db.Where("friend_id = ?", query.UserID)
+	} else {
+		db = db.Where("user_id = ?", query.UserID)
+	}
+	if query.Status != "" {
+		db = db.Where("status = ?", query.Status)
+	} else {
+		db = db.Where("status <> ?", FriendBlocked)
+	}
+	if query.Before > 0 {
+		db = db.Where("id < ?", query.Before)
+	}
+	err := db.Order("id desc").Limit(query.Limit).Find(&friends).Error
+	if err != nil {
+		return nil, err
+	}
+	return friends, nil
+}
+
 func (fg *friendGorm) Create(friend *Friend) error {
-	return fg.db.Create(friend).Error
+	return friendConstraintError(fg.db.Create(friend).Error)
 }
 
 func (fg *friendGorm) Update(friend *Friend) error {
-	return fg.db.Save(friend).Error
+	return friendConstraintError(fg.db.Save(friend).Error)
+}
+
+// friendConstraintError turns violations of the constraints on
+// the friends table into the errors the validator would have
+// returned, had it seen the clash coming.
+func friendConstraintError(err error) error {
+	switch violated(err) {
+	case constraintUnique:
+		return ErrFriendRequestExists
+	case constraintCheck:
+		return ErrFriendSelf
+	case constraintForeignKey:
+		return ErrFriendUserNotFound
+	}
+	return err
 }
 
 func (fg *friendGorm) Delete(id uint) error {
 	friend := Friend{Model: gorm.Model{ID: id}}
 	return fg.db.Delete(&friend).Error
 }
+
+func (fg *friendGorm) SaveBlock(block *Friend, severID uint) error {
+	return fg.db.Transaction(func(tx *gorm.DB) error {
+		if severID > 0 {
+			sever := Friend{Model: gorm.Model{ID: severID}}
+			if err := tx.Delete(&sever).Error; err != nil {
+				return err
+			}
+		}
+		return friendConstraintError(tx.Save(block).Error)
+	})
+}
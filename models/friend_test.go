@@ -0,0 +1,44 @@
+package models
+
+import "testing"
+
+func TestFriendConstraints(t *testing.T) {
+	s := newSQLiteServices(t)
+	ug := &userDbHandle{s.db}
+	fg := &friendGorm{s.db}
+	ann := mustCreateUser(t, ug, "ann@example.com", "ann")
+	bob := mustCreateUser(t, ug, "bob@example.com", "bob")
+
+	request := Friend{UserID: ann.ID, FriendID: bob.ID, Status: FriendPending}
+	if err := fg.Create(&request); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		friend Friend
+		want   error
+	}{
+		{"duplicate", Friend{UserID: ann.ID, FriendID: bob.ID, Status: FriendPending}, ErrFriendRequestExists},
+		{"self", Friend{UserID: ann.ID, FriendID: ann.ID, Status: FriendPending}, ErrFriendSelf},
+		{"missing user", Friend{UserID: ann.ID, FriendID: bob.ID + 100, Status: FriendPending}, ErrFriendUserNotFound},
+		{"reverse", Friend{UserID: bob.ID, FriendID: ann.ID, Status: FriendPending}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			friend := tt.friend
+			if err := fg.Create(&friend); err != tt.want {
+				t.Errorf("Create = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// Uniqueness only applies to live rows.
+	if err := fg.Delete(request.ID); err != nil {
+		t.Fatal(err)
+	}
+	again := Friend{UserID: ann.ID, FriendID: bob.ID, Status: FriendPending}
+	if err := fg.Create(&again); err != nil {
+		t.Fatalf("Create after delete = %v, want nil", err)
+	}
+}
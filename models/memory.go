@@ -0,0 +1,782 @@
+package models
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The Memory* types are in-memory stand-ins for the gorm
+// backed UserDB, FriendDB, MessageDB and ConversationDB. They
+// behave like the database does: lookups of missing or deleted
+// rows return ErrNotFound, unique indexes are enforced (soft
+// deleted rows included), Create fills in the ID and
+// timestamps, and Delete is a soft delete. They are safe for
+// concurrent use and meant for tests and local experiments,
+// not for production.
+
+// MemoryUserDB is an in-memory UserDB.
+type MemoryUserDB struct {
+	mu     sync.RWMutex
+	nextID uint
+	rows   map[uint]User
+}
+
+func NewMemoryUserDB() *MemoryUserDB {
+	return &MemoryUserDB{rows: make(map[uint]User)}
+}
+
+func (m *MemoryUserDB) ByID(id uint) (*User, error) {
+	return m.find(func(u *User) bool { return u.ID == id })
+}
+
+func (m *MemoryUserDB) ByIDs(ids []uint) ([]User, error) {
+	wanted := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	return m.filter(func(u *User) bool { return wanted[u.ID] }), nil
+}
+
+func (m *MemoryUserDB) ByEmail(email string) (*User, error) {
+	return m.find(func(u *User) bool { return u.Email == email })
+}
+
+func (m *MemoryUserDB) ByHandle(handle string) (*User, error) {
+	return m.find(func(u *User) bool { return u.Handle == handle })
+}
+
+// Search matches handles as they are, like the database's
+// LIKE does: handles are stored lower case and the validator
+// lower cases the query. Names are compared lower case, as in
+// the LOWER(name) the database searches.
+func (m *MemoryUserDB) Search(query string, exclude []uint, limit int) ([]User, error) {
+	excluded := make(map[uint]bool, len(exclude))
+	for _, id := range exclude {
+		excluded[id] = true
+	}
+	users := m.filter(func(u *User) bool {
+		return !excluded[u.ID] &&
+			(strings.HasPrefix(u.Handle, query) || strings.HasPrefix(strings.ToLower(u.Name), query))
+	})
+	sort.SliceStable(users, func(i, j int) bool { return users[i].Handle < users[j].Handle })
+	if limit > 0 && len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+func (m *MemoryUserDB) Create(user *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.unique(user); err != nil {
+		return err
+	}
+	m.nextID++
+	now := time.Now()
+	user.ID = m.nextID
+	user.CreatedAt, user.UpdatedAt = now, now
+	m.rows[user.ID] = *user
+	return nil
+}
+
+func (m *MemoryUserDB) Update(user *User) error {
+	if user.ID == 0 {
+		return m.Create(user)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.unique(user); err != nil {
+		return err
+	}
+	user.UpdatedAt = time.Now()
+	m.rows[user.ID] = *user
+	return nil
+}
+
+func (m *MemoryUserDB) SetLastSeen(id uint, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if u, ok := m.rows[id]; ok && u.DeletedAt == nil {
+		u.LastSeenAt = &at
+		m.rows[id] = u
+	}
+	return nil
+}
+
+func (m *MemoryUserDB) Delete(id uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if u, ok := m.rows[id]; ok && u.DeletedAt == nil {
+		now := time.Now()
+		u.DeletedAt = &now
+		m.rows[id] = u
+	}
+	return nil
+}
+
+// unique mirrors the unique indexes on email and handle. The
+// caller must hold the write lock.
+func (m *MemoryUserDB) unique(user *User) error {
+	for id, u := range m.rows {
+		if id != user.ID && (u.Email == user.Email || u.Handle == user.Handle) {
+			return ErrDuplicate
+		}
+	}
+	return nil
+}
+
+func (m *MemoryUserDB) find(match func(*User) bool) (*User, error) {
+	users := m.filter(match)
+	if len(users) == 0 {
+		return nil, ErrNotFound
+	}
+	return &users[0], nil
+}
+
+// filter returns copies of the live rows that match, in ID
+// order.
+func (m *MemoryUserDB) filter(match func(*User) bool) []User {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	users := []User{}
+	for _, u := range m.rows {
+		if u.DeletedAt == nil && match(&u) {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users
+}
+
+// MemoryFriendDB is an in-memory FriendDB.
+type MemoryFriendDB struct {
+	mu     sync.RWMutex
+	nextID uint
+	rows   map[uint]Friend
+}
+
+func NewMemoryFriendDB() *MemoryFriendDB {
+	return &MemoryFriendDB{rows: make(map[uint]Friend)}
+}
+
+func (m *MemoryFriendDB) ByID(id uint) (*Friend, error) {
+	return m.find(func(f *Friend) bool { return f.ID == id })
+}
+
+func (m *MemoryFriendDB) ByUserID(userID uint) ([]Friend, error) {
+	return m.filter(func(f *Friend) bool { return f.UserID == userID }), nil
+}
+
+func (m *MemoryFriendDB) ByFriendID(friendID uint) ([]Friend, error) {
+	return m.filter(func(f *Friend) bool { return f.FriendID == friendID }), nil
+}
+
+func (m *MemoryFriendDB) ByUserAndFriendID(userID, friendID uint) (*Friend, error) {
+	return m.find(func(f *Friend) bool { return f.UserID == userID && f.FriendID == friendID })
+}
+
+func (m *MemoryFriendDB) Find(query FriendQuery) ([]Friend, error) {
+	friends := m.filter(func(f *Friend) bool {
+		side := f.UserID
+		if query.Direction == FriendIncoming {
+			side = f.FriendID
+		}
+		status := f.Status == query.Status
+		if query.Status == "" {
+			status = f.Status != FriendBlocked
+		}
+		return side == query.UserID && status && (query.Before == 0 || f.ID < query.Before)
+	})
+	// Newest first, like the database query.
+	for i, j := 0, len(friends)-1; i < j; i, j = i+1, j-1 {
+		friends[i], friends[j] = friends[j], friends[i]
+	}
+	if query.Limit > 0 && len(friends) > query.Limit {
+		friends = friends[:query.Limit]
+	}
+	return friends, nil
+}
+
+func (m *MemoryFriendDB) Create(friend *Friend) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.check(friend); err != nil {
+		return err
+	}
+	m.nextID++
+	now := time.Now()
+	friend.ID = m.nextID
+	friend.CreatedAt, friend.UpdatedAt = now, now
+	m.rows[friend.ID] = *friend
+	return nil
+}
+
+func (m *MemoryFriendDB) Update(friend *Friend) error {
+	if friend.ID == 0 {
+		return m.Create(friend)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.check(friend); err != nil {
+		return err
+	}
+	friend.UpdatedAt = time.Now()
+	m.rows[friend.ID] = *friend
+	return nil
+}
+
+func (m *MemoryFriendDB) Delete(id uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f, ok := m.rows[id]; ok && f.DeletedAt == nil {
+		now := time.Now()
+		f.DeletedAt = &now
+		m.rows[id] = f
+	}
+	return nil
+}
+
+func (m *MemoryFriendDB) SaveBlock(block *Friend, severID uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.check(block); err != nil {
+		return err
+	}
+	now := time.Now()
+	if f, ok := m.rows[severID]; ok && f.DeletedAt == nil {
+		f.DeletedAt = &now
+		m.rows[severID] = f
+	}
+	if block.ID == 0 {
+		m.nextID++
+		block.ID = m.nextID
+		block.CreatedAt = now
+	}
+	block.UpdatedAt = now
+	m.rows[block.ID] = *block
+	return nil
+}
+
+// check mirrors the constraints on the friends table and
+// returns the same errors friendGorm maps them to. The caller
+// must hold the write lock.
+func (m *MemoryFriendDB) check(friend *Friend) error {
+	if friend.UserID == friend.FriendID {
+		return ErrFriendSelf
+	}
+	if friend.DeletedAt != nil {
+		return nil
+	}
+	for id, f := range m.rows {
+		if id != friend.ID && f.DeletedAt == nil &&
+			f.UserID == friend.UserID && f.FriendID == friend.FriendID {
+			return ErrFriendRequestExists
+		}
+	}
+	return nil
+}
+
+func (m *MemoryFriendDB) find(match func(*Friend) bool) (*Friend, error) {
+	friends := m.filter(match)
+	if len(friends) == 0 {
+		return nil, ErrNotFound
+	}
+	return &friends[0], nil
+}
+
+func (m *MemoryFriendDB) filter(match func(*Friend) bool) []Friend {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	friends := []Friend{}
+	for _, f := range m.rows {
+		if f.DeletedAt == nil && match(&f) {
+			friends = append(friends, f)
+		}
+	}
+	sort.Slice(friends, func(i, j int) bool { return friends[i].ID < friends[j].ID })
+	return friends
+}
+
+// MemoryMessageDB is an in-memory MessageDB.
+type MemoryMessageDB struct {
+	mu     sync.RWMutex
+	nextID uint
+	rows   map[uint]Message
+	edits  []MessageEdit
+	// reactions is kept in the order they were made, with
+	// deleted ones left in place like soft deleted rows.
+	reactions []Reaction
+	// cursors holds read cursors keyed by user and partner ID.
+	cursors      map[[2]uint]ReadCursor
+	nextCursorID uint
+}
+
+func NewMemoryMessageDB() *MemoryMessageDB {
+	return &MemoryMessageDB{
+		rows:    make(map[uint]Message),
+		cursors: make(map[[2]uint]ReadCursor),
+	}
+}
+
+func (m *MemoryMessageDB) ReadCursor(userID, partnerID uint) (*ReadCursor, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	cursor, ok := m.cursors[[2]uint{userID, partnerID}]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &cursor, nil
+}
+
+func (m *MemoryMessageDB) SaveReadCursor(cursor *ReadCursor) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := [2]uint{cursor.UserID, cursor.PartnerID}
+	if existing, ok := m.cursors[key]; ok && existing.ID != cursor.ID {
+		return ErrDuplicate
+	}
+	now := time.Now()
+	if cursor.ID == 0 {
+		m.nextCursorID++
+		cursor.ID = m.nextCursorID
+		cursor.CreatedAt = now
+	}
+	cursor.UpdatedAt = now
+	m.cursors[key] = *cursor
+	return nil
+}
+
+func (m *MemoryMessageDB) UnreadCounts(userID uint) (map[uint]int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	counts := make(map[uint]int)
+	for _, msg := range m.rows {
+		if msg.DeletedAt != nil || msg.RecipientID != userID {
+			continue
+		}
+		if msg.ID > m.cursors[[2]uint{userID, msg.SenderID}].LastReadMessageID {
+			counts[msg.SenderID]++
+		}
+	}
+	return counts, nil
+}
+
+func (m *MemoryMessageDB) Edits(messageID uint) ([]MessageEdit, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	edits := []MessageEdit{}
+	for _, e := range m.edits {
+		if e.MessageID == messageID {
+			edits = append(edits, e)
+		}
+	}
+	return edits, nil
+}
+
+func (m *MemoryMessageDB) SaveEdit(message *Message, edit *MessageEdit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	message.UpdatedAt = now
+	m.rows[message.ID] = *message
+	edit.ID = uint(len(m.edits) + 1)
+	edit.CreatedAt, edit.UpdatedAt = now, now
+	m.edits = append(m.edits, *edit)
+	return nil
+}
+
+func (m *MemoryMessageDB) Reaction(messageID, userID uint, emoji string) (*Reaction, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, r := range m.reactions {
+		if r.DeletedAt == nil && r.MessageID == messageID && r.UserID == userID && r.Emoji == emoji {
+			return &r, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *MemoryMessageDB) CreateReaction(reaction *Reaction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range m.reactions {
+		if r.DeletedAt == nil && r.MessageID == reaction.MessageID &&
+			r.UserID == reaction.UserID && r.Emoji == reaction.Emoji {
+			return ErrReactionExists
+		}
+	}
+	now := time.Now()
+	reaction.ID = uint(len(m.reactions) + 1)
+	reaction.CreatedAt, reaction.UpdatedAt = now, now
+	m.reactions = append(m.reactions, *reaction)
+	return nil
+}
+
+func (m *MemoryMessageDB) DeleteReaction(id uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if id <= uint(len(m.reactions)) && m.reactions[id-1].DeletedAt == nil {
+		now := time.Now()
+		m.reactions[id-1].DeletedAt = &now
+	}
+	return nil
+}
+
+func (m *MemoryMessageDB) ReactionCounts(messageIDs []uint, userID uint) (map[uint][]ReactionCount, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	wanted := make(map[uint]bool, len(messageIDs))
+	for _, id := range messageIDs {
+		wanted[id] = true
+	}
+	counts := make(map[uint][]ReactionCount)
+	for _, r := range m.reactions {
+		if r.DeletedAt != nil || !wanted[r.MessageID] {
+			continue
+		}
+		list := counts[r.MessageID]
+		i := 0
+		for i < len(list) && list[i].Emoji != r.Emoji {
+			i++
+		}
+		if i == len(list) {
+			list = append(list, ReactionCount{Emoji: r.Emoji})
+		}
+		list[i].Count++
+		if r.UserID == userID {
+			list[i].Reacted = true
+		}
+		counts[r.MessageID] = list
+	}
+	return counts, nil
+}
+
+func (m *MemoryMessageDB) ByID(id uint) (*Message, error) {
+	messages := m.filter(false, func(msg *Message) bool { return msg.ID == id })
+	if len(messages) == 0 {
+		return nil, ErrNotFound
+	}
+	return &messages[0], nil
+}
+
+func (m *MemoryMessageDB) Parent(id uint) (*Message, error) {
+	messages := m.filter(true, func(msg *Message) bool { return msg.ID == id })
+	if len(messages) == 0 {
+		return nil, ErrNotFound
+	}
+	return &messages[0], nil
+}
+
+func (m *MemoryMessageDB) Conversation(userID, partnerID, before uint, limit int) ([]Message, error) {
+	messages := m.filter(true, func(msg *Message) bool {
+		return msg.Between(userID, partnerID) && (before == 0 || msg.ID < before)
+	})
+	// Keep the newest page, still oldest first.
+	if limit > 0 && len(messages) > limit {
+		messages = messages[len(messages)-limit:]
+	}
+	return messages, nil
+}
+
+func (m *MemoryMessageDB) Group(conversationID, before uint, limit int) ([]Message, error) {
+	messages := m.filter(true, func(msg *Message) bool {
+		return msg.ConversationID == conversationID && (before == 0 || msg.ID < before)
+	})
+	if limit > 0 && len(messages) > limit {
+		messages = messages[len(messages)-limit:]
+	}
+	return messages, nil
+}
+
+func (m *MemoryMessageDB) Replies(parentID, before uint, limit int) ([]Message, error) {
+	messages := m.filter(true, func(msg *Message) bool {
+		return msg.ParentID == parentID && (before == 0 || msg.ID < before)
+	})
+	if limit > 0 && len(messages) > limit {
+		messages = messages[len(messages)-limit:]
+	}
+	return messages, nil
+}
+
+func (m *MemoryMessageDB) ReplyCounts(messageIDs []uint) (map[uint]int, error) {
+	wanted := make(map[uint]bool, len(messageIDs))
+	for _, id := range messageIDs {
+		wanted[id] = true
+	}
+	counts := make(map[uint]int)
+	for _, msg := range m.filter(false, func(msg *Message) bool { return wanted[msg.ParentID] }) {
+		counts[msg.ParentID]++
+	}
+	return counts, nil
+}
+
+func (m *MemoryMessageDB) Create(message *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	now := time.Now()
+	message.ID = m.nextID
+	message.CreatedAt, message.UpdatedAt = now, now
+	m.rows[message.ID] = *message
+	return nil
+}
+
+func (m *MemoryMessageDB) Update(message *Message) error {
+	if message.ID == 0 {
+		return m.Create(message)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	message.UpdatedAt = time.Now()
+	m.rows[message.ID] = *message
+	return nil
+}
+
+func (m *MemoryMessageDB) Delete(id uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if msg, ok := m.rows[id]; ok && msg.DeletedAt == nil {
+		now := time.Now()
+		msg.DeletedAt = &now
+		m.rows[id] = msg
+	}
+	return nil
+}
+
+// filter returns the messages match accepts, oldest first.
+// Deleted messages are only considered if deleted is true.
+func (m *MemoryMessageDB) filter(deleted bool, match func(*Message) bool) []Message {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	messages := []Message{}
+	for _, msg := range m.rows {
+		if (deleted || msg.DeletedAt == nil) && match(&msg) {
+			messages = append(messages, msg)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+	return messages
+}
+
+// MemoryConversationDB is an in-memory ConversationDB.
+type MemoryConversationDB struct {
+	mu           sync.RWMutex
+	nextID       uint
+	rows         map[uint]Conversation
+	nextMemberID uint
+	members      map[uint]ConversationMember
+}
+
+func NewMemoryConversationDB() *MemoryConversationDB {
+	return &MemoryConversationDB{
+		rows:    make(map[uint]Conversation),
+		members: make(map[uint]ConversationMember),
+	}
+}
+
+func (m *MemoryConversationDB) ByID(id uint) (*Conversation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	c, ok := m.rows[id]
+	if !ok || c.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+	return &c, nil
+}
+
+func (m *MemoryConversationDB) ByUserID(userID uint) ([]Conversation, error) {
+	in := make(map[uint]bool)
+	for _, member := range m.filterMembers(func(cm *ConversationMember) bool { return cm.UserID == userID }) {
+		in[member.ConversationID] = true
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	conversations := []Conversation{}
+	for _, c := range m.rows {
+		if c.DeletedAt == nil && in[c.ID] {
+			conversations = append(conversations, c)
+		}
+	}
+	// Newest first, like the database query.
+	sort.Slice(conversations, func(i, j int) bool { return conversations[i].ID > conversations[j].ID })
+	return conversations, nil
+}
+
+func (m *MemoryConversationDB) Create(conversation *Conversation, members []ConversationMember) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// A brand new conversation can only clash with itself.
+	seen := make(map[uint]bool, len(members))
+	for _, member := range members {
+		if seen[member.UserID] {
+			return ErrConversationMemberExists
+		}
+		seen[member.UserID] = true
+	}
+	m.nextID++
+	now := time.Now()
+	conversation.ID = m.nextID
+	conversation.CreatedAt, conversation.UpdatedAt = now, now
+	m.rows[conversation.ID] = *conversation
+	for i := range members {
+		m.nextMemberID++
+		members[i].ID = m.nextMemberID
+		members[i].ConversationID = conversation.ID
+		members[i].CreatedAt, members[i].UpdatedAt = now, now
+		m.members[members[i].ID] = members[i]
+	}
+	return nil
+}
+
+func (m *MemoryConversationDB) Update(conversation *Conversation) error {
+	if conversation.ID == 0 {
+		return m.Create(conversation, nil)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conversation.UpdatedAt = time.Now()
+	m.rows[conversation.ID] = *conversation
+	return nil
+}
+
+func (m *MemoryConversationDB) Delete(id uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.rows[id]; ok && c.DeletedAt == nil {
+		now := time.Now()
+		c.DeletedAt = &now
+		m.rows[id] = c
+	}
+	return nil
+}
+
+func (m *MemoryConversationDB) Members(conversationID uint) ([]ConversationMember, error) {
+	return m.filterMembers(func(cm *ConversationMember) bool { return cm.ConversationID == conversationID }), nil
+}
+
+func (m *MemoryConversationDB) Member(conversationID, userID uint) (*ConversationMember, error) {
+	members := m.filterMembers(func(cm *ConversationMember) bool {
+		return cm.ConversationID == conversationID && cm.UserID == userID
+	})
+	if len(members) == 0 {
+		return nil, ErrNotFound
+	}
+	return &members[0], nil
+}
+
+func (m *MemoryConversationDB) CreateMembers(members []ConversationMember) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, member := range members {
+		if err := m.checkMember(&member); err != nil {
+			return err
+		}
+		for _, other := range members[:i] {
+			if other.ConversationID == member.ConversationID && other.UserID == member.UserID {
+				return ErrConversationMemberExists
+			}
+		}
+	}
+	now := time.Now()
+	for i := range members {
+		m.nextMemberID++
+		members[i].ID = m.nextMemberID
+		members[i].CreatedAt, members[i].UpdatedAt = now, now
+		m.members[members[i].ID] = members[i]
+	}
+	return nil
+}
+
+func (m *MemoryConversationDB) UpdateMember(member *ConversationMember) error {
+	if member.ID == 0 {
+		return m.CreateMembers([]ConversationMember{*member})
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkMember(member); err != nil {
+		return err
+	}
+	member.UpdatedAt = time.Now()
+	m.members[member.ID] = *member
+	return nil
+}
+
+func (m *MemoryConversationDB) DeleteMember(id uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cm, ok := m.members[id]; ok && cm.DeletedAt == nil {
+		now := time.Now()
+		cm.DeletedAt = &now
+		m.members[id] = cm
+	}
+	return nil
+}
+
+func (m *MemoryConversationDB) HandOver(owner, next *ConversationMember) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current, ok := m.members[owner.ID]
+	if !ok || current.DeletedAt != nil || current.Role != RoleOwner {
+		return ErrConversationForbidden
+	}
+	heir, ok := m.members[next.ID]
+	if !ok || heir.DeletedAt != nil || heir.ConversationID != current.ConversationID {
+		return ErrNotFound
+	}
+	now := time.Now()
+	current.Role, current.UpdatedAt = RoleAdmin, now
+	heir.Role, heir.UpdatedAt = RoleOwner, now
+	m.members[current.ID], m.members[heir.ID] = current, heir
+	owner.Role, next.Role = RoleAdmin, RoleOwner
+	return nil
+}
+
+func (m *MemoryConversationDB) DeleteWithLastMember(id, memberID uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, cm := range m.members {
+		if cm.DeletedAt == nil && cm.ConversationID == id && cm.ID != memberID {
+			return ErrConversationOwnerLeaving
+		}
+	}
+	now := time.Now()
+	if cm, ok := m.members[memberID]; ok && cm.DeletedAt == nil {
+		cm.DeletedAt = &now
+		m.members[memberID] = cm
+	}
+	if c, ok := m.rows[id]; ok && c.DeletedAt == nil {
+		c.DeletedAt = &now
+		m.rows[id] = c
+	}
+	return nil
+}
+
+// checkMember mirrors the unique index on conversation_members.
+// The caller must hold the write lock.
+func (m *MemoryConversationDB) checkMember(member *ConversationMember) error {
+	if member.DeletedAt != nil {
+		return nil
+	}
+	for id, cm := range m.members {
+		if id != member.ID && cm.DeletedAt == nil &&
+			cm.ConversationID == member.ConversationID && cm.UserID == member.UserID {
+			return ErrConversationMemberExists
+		}
+	}
+	return nil
+}
+
+func (m *MemoryConversationDB) filterMembers(match func(*ConversationMember) bool) []ConversationMember {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	members := []ConversationMember{}
+	for _, cm := range m.members {
+		if cm.DeletedAt == nil && match(&cm) {
+			members = append(members, cm)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members
+}
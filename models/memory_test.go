@@ -0,0 +1,274 @@
+package models
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// testStore is one UserDB and FriendDB pair, along with
+// services built on them, so the same cases can run against
+// the database and the in-memory stores.
+type testStore struct {
+	name    string
+	users   UserDB
+	friends FriendDB
+	user    UserService
+	friend  FriendService
+}
+
+func testStores(t *testing.T) []testStore {
+	s := newSQLiteServices(t)
+	users := NewMemoryUserDB()
+	friends := NewMemoryFriendDB()
+	user := newUserService(users, testPepper)
+	return []testStore{
+		{
+			name:    "sqlite",
+			users:   &userDbHandle{s.db},
+			friends: &friendGorm{s.db},
+			user:    s.User,
+			friend:  s.Friend,
+		},
+		{
+			name:    "memory",
+			users:   users,
+			friends: friends,
+			user:    user,
+			friend:  newFriendService(friends, user),
+		},
+	}
+}
+
+func TestUserDBs(t *testing.T) {
+	for _, store := range testStores(t) {
+		t.Run(store.name, func(t *testing.T) {
+			udb := store.users
+			ann := mustCreateUser(t, udb, "ann@example.com", "ann")
+			gone := mustCreateUser(t, udb, "gone@example.com", "gone")
+			if err := udb.Delete(gone.ID); err != nil {
+				t.Fatal(err)
+			}
+
+			lookups := []struct {
+				name string
+				fn   func() (*User, error)
+				want error
+			}{
+				{"by id", func() (*User, error) { return udb.ByID(ann.ID) }, nil},
+				{"missing id", func() (*User, error) { return udb.ByID(ann.ID + 100) }, ErrNotFound},
+				{"deleted id", func() (*User, error) { return udb.ByID(gone.ID) }, ErrNotFound},
+				{"by email", func() (*User, error) { return udb.ByEmail("ann@example.com") }, nil},
+				{"missing email", func() (*User, error) { return udb.ByEmail("bob@example.com") }, ErrNotFound},
+				{"deleted email", func() (*User, error) { return udb.ByEmail("gone@example.com") }, ErrNotFound},
+				{"by handle", func() (*User, error) { return udb.ByHandle("ann") }, nil},
+				{"deleted handle", func() (*User, error) { return udb.ByHandle("gone") }, ErrNotFound},
+			}
+			for _, tt := range lookups {
+				if _, err := tt.fn(); err != tt.want {
+					t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+				}
+			}
+
+			dups := []struct {
+				name, email, handle string
+			}{
+				{"email", "ann@example.com", "ann2"},
+				{"handle", "ann2@example.com", "ann"},
+				{"deleted email", "gone@example.com", "gone2"},
+			}
+			for _, tt := range dups {
+				user := User{Email: tt.email, Handle: tt.handle, PasswordHash: "hash"}
+				if err := udb.Create(&user); err != ErrDuplicate {
+					t.Errorf("create with duplicate %s: err = %v, want ErrDuplicate", tt.name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestUserDBSearch(t *testing.T) {
+	for _, store := range testStores(t) {
+		t.Run(store.name, func(t *testing.T) {
+			udb := store.users
+			for _, u := range []struct{ handle, name string }{
+				{"al_ex", "Alex Smith"},
+				{"alfie", "Alfie"},
+				{"fred", "ALfred"},
+				{"bob", "Bobby Al"},
+			} {
+				user := User{Name: u.name, Email: u.handle + "@example.com", Handle: u.handle, PasswordHash: "hash"}
+				if err := udb.Create(&user); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tests := []struct {
+				query string
+				want  []string
+			}{
+				{"al", []string{"al_ex", "alfie", "fred"}},
+				{"al_", []string{"al_ex"}},
+				{"al%", nil},
+				{"alf", []string{"alfie", "fred"}},
+				{"bob", []string{"bob"}},
+			}
+			for _, tt := range tests {
+				users, err := udb.Search(tt.query, nil, 10)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				for _, u := range users {
+					got = append(got, u.Handle)
+				}
+				if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+					t.Errorf("Search(%q) = %v, want %v", tt.query, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFriendDBs(t *testing.T) {
+	for _, store := range testStores(t) {
+		t.Run(store.name, func(t *testing.T) {
+			ann := mustCreateUser(t, store.users, "ann@example.com", "ann")
+			bob := mustCreateUser(t, store.users, "bob@example.com", "bob")
+			fdb := store.friends
+
+			request := Friend{UserID: ann.ID, FriendID: bob.ID, Status: FriendPending}
+			if err := fdb.Create(&request); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := fdb.ByUserAndFriendID(bob.ID, ann.ID); err != ErrNotFound {
+				t.Errorf("reverse lookup: err = %v, want ErrNotFound", err)
+			}
+			dup := Friend{UserID: ann.ID, FriendID: bob.ID, Status: FriendPending}
+			if err := fdb.Create(&dup); err != ErrFriendRequestExists {
+				t.Errorf("duplicate: err = %v, want ErrFriendRequestExists", err)
+			}
+			self := Friend{UserID: ann.ID, FriendID: ann.ID, Status: FriendPending}
+			if err := fdb.Create(&self); err != ErrFriendSelf {
+				t.Errorf("self: err = %v, want ErrFriendSelf", err)
+			}
+
+			if err := fdb.Delete(request.ID); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := fdb.ByID(request.ID); err != ErrNotFound {
+				t.Errorf("deleted: err = %v, want ErrNotFound", err)
+			}
+			again := Friend{UserID: ann.ID, FriendID: bob.ID, Status: FriendPending}
+			if err := fdb.Create(&again); err != nil {
+				t.Errorf("create after delete: err = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestFriendServiceRequestAfterDecline(t *testing.T) {
+	for _, store := range testStores(t) {
+		t.Run(store.name, func(t *testing.T) {
+			ann := User{Email: "ann@example.com", Password: "password123"}
+			bob := User{Email: "bob@example.com", Password: "password123"}
+			for _, u := range []*User{&ann, &bob} {
+				if err := store.user.Create(u); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			request, err := store.friend.Request(ann.ID, "bob@example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.friend.Request(ann.ID, "bob@example.com"); err != ErrFriendRequestExists {
+				t.Errorf("pending request again: err = %v, want ErrFriendRequestExists", err)
+			}
+			if _, err := store.friend.Decline(request.ID, bob.ID); err != nil {
+				t.Fatal(err)
+			}
+			again, err := store.friend.Request(ann.ID, "bob@example.com")
+			if err != nil {
+				t.Fatalf("request after decline: %v", err)
+			}
+			if again.Status != FriendPending || again.ID == request.ID {
+				t.Errorf("request after decline = %+v, want a new pending request", again)
+			}
+		})
+	}
+}
+
+// TestUserDBConcurrentCreate races creates of the same email
+// against each other; run with -race to check the stores are
+// safe for concurrent use.
+func TestUserDBConcurrentCreate(t *testing.T) {
+	const workers = 20
+	for _, store := range testStores(t) {
+		t.Run(store.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			errs := make(chan error, 2*workers)
+			for i := 0; i < workers; i++ {
+				wg.Add(2)
+				go func(i int) {
+					defer wg.Done()
+					user := User{Email: "same@example.com", Handle: fmt.Sprintf("same%d", i), PasswordHash: "hash"}
+					errs <- store.users.Create(&user)
+				}(i)
+				go func(i int) {
+					defer wg.Done()
+					user := User{Email: fmt.Sprintf("user%d@example.com", i), Handle: fmt.Sprintf("user%d", i), PasswordHash: "hash"}
+					errs <- store.users.Create(&user)
+					store.users.Search("user", nil, 10)
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+
+			created := 0
+			for err := range errs {
+				switch err {
+				case nil:
+					created++
+				case ErrDuplicate:
+				default:
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+			if created != workers+1 {
+				t.Errorf("created %d users, want %d", created, workers+1)
+			}
+		})
+	}
+}
+
+func TestFriendServiceBlock(t *testing.T) {
+	for _, store := range testStores(t) {
+		t.Run(store.name, func(t *testing.T) {
+			ann := mustCreateUser(t, store.users, "ann@example.com", "ann")
+			bob := mustCreateUser(t, store.users, "bob@example.com", "bob")
+			request := Friend{UserID: ann.ID, FriendID: bob.ID, Status: FriendAccepted}
+			if err := store.friends.Create(&request); err != nil {
+				t.Fatal(err)
+			}
+
+			block, err := store.friend.Block(bob.ID, ann.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if block.Status != FriendBlocked || block.UserID != bob.ID {
+				t.Errorf("block = %+v, want bob's block on ann", block)
+			}
+			if _, err := store.friends.ByID(request.ID); err != ErrNotFound {
+				t.Errorf("ann's row after block: err = %v, want ErrNotFound", err)
+			}
+			again, err := store.friend.Block(bob.ID, ann.ID)
+			if err != nil || again.ID != block.ID {
+				t.Errorf("block again = %+v, %v, want the same block", again, err)
+			}
+			if _, err := store.friend.Block(bob.ID, bob.ID); err != ErrBlockSelf {
+				t.Errorf("block self: err = %v, want ErrBlockSelf", err)
+			}
+		})
+	}
+}
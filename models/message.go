@@ -0,0 +1,450 @@
+package models
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// messageMaxLength is the longest message body, in
+	// characters, that we will store.
+	messageMaxLength = 4000
+	// DefaultMessageLimit is how many messages a conversation
+	// page holds when the caller does not ask for a size.
+	DefaultMessageLimit = 50
+	// MaxMessageLimit caps the size of a conversation page.
+	MaxMessageLimit = 100
+)
+
+// Message is a direct message from one user to another, or a
+// message to a group. Exactly one of RecipientID and
+// ConversationID is set; the other is zero. CreatedAt and
+// DeletedAt come from gorm.Model; EditedAt is set whenever the
+// body changes after the message was sent.
+//
+// A reply has ParentID set to the message it answers, which is
+// in the same conversation. QuoteSenderID and QuoteBody are a
+// copy of the parent taken when the reply was sent, so the
+// quote reads the same after the parent is edited or deleted.
+type Message struct {
+	gorm.Model
+	SenderID       uint   `gorm:"not null;index"`
+	RecipientID    uint   `gorm:"not null;index"`
+	ConversationID uint   `gorm:"not null;default:0;index"`
+	ParentID       uint   `gorm:"not null;default:0;index"`
+	Body           string `gorm:"type:text;not null"`
+	QuoteSenderID  uint   `gorm:"not null;default:0"`
+	QuoteBody      string `gorm:"type:text;not null;default:''"`
+	EditedAt       *time.Time
+}
+
+// Between reports whether m was exchanged between the two
+// users, in either direction.
+func (m *Message) Between(userID, otherID uint) bool {
+	return (m.SenderID == userID && m.RecipientID == otherID) ||
+		(m.SenderID == otherID && m.RecipientID == userID)
+}
+
+type MessageService interface {
+	// MarkRead moves userID's read cursor in the conversation
+	// with partnerID up to messageID, or to the latest message
+	// if messageID is zero. Cursors never move backwards, so
+	// the returned cursor may be ahead of messageID; moved
+	// reports whether this call advanced it.
+	MarkRead(userID, partnerID, messageID uint) (cursor *ReadCursor, moved bool, err error)
+	// Edit replaces the body of message id on behalf of
+	// userID, who must have sent it within the edit window.
+	// The old body is kept as a MessageEdit.
+	Edit(id, userID uint, body string) (*Message, error)
+	// Retract deletes message id on behalf of userID, who must
+	// have sent it within the edit window. The message stays
+	// in history as a tombstone.
+	Retract(id, userID uint) (*Message, error)
+	// React adds userID's reaction to message id, which they
+	// must be able to see. emoji must be a single emoji.
+	React(id, userID uint, emoji string) (*Reaction, error)
+	// Unreact takes back userID's reaction to message id and
+	// returns it.
+	Unreact(id, userID uint, emoji string) (*Reaction, error)
+	// Thread returns message id, which userID must be able to
+	// see, and a page of the replies to it. Replies are paged
+	// like Conversation. A deleted message is still returned,
+	// as a tombstone, so its replies stay reachable.
+	Thread(id, userID, before uint, limit int) (*Message, []Message, error)
+	MessageDB
+}
+
+type MessageDB interface {
+	ByID(id uint) (*Message, error)
+	// Conversation returns up to limit messages exchanged
+	// between userID and partnerID, oldest first. If before is
+	// non-zero only messages with a smaller ID are returned,
+	// which lets callers page backwards through history.
+	// Deleted messages are included, with DeletedAt set, so
+	// that clients can show where they were; their body must
+	// not be shown.
+	Conversation(userID, partnerID, before uint, limit int) ([]Message, error)
+	// Group is Conversation for the messages sent to the group
+	// conversationID.
+	Group(conversationID, before uint, limit int) ([]Message, error)
+	Create(message *Message) error
+	Update(message *Message) error
+	Delete(id uint) error
+	ReadCursorDB
+	MessageEditDB
+	ReactionDB
+	ThreadDB
+}
+
+type messageService struct {
+	MessageDB
+	friends       FriendDB
+	conversations ConversationDB
+	editWindow    time.Duration
+}
+
+func (ms *messageService) MarkRead(userID, partnerID, messageID uint) (*ReadCursor, bool, error) {
+	if messageID == 0 {
+		latest, err := ms.Conversation(userID, partnerID, 0, 1)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(latest) == 0 {
+			return nil, false, ErrNotFound
+		}
+		messageID = latest[0].ID
+	} else {
+		message, err := ms.ByID(messageID)
+		if err != nil {
+			return nil, false, err
+		}
+		if !message.Between(userID, partnerID) {
+			return nil, false, ErrNotFound
+		}
+	}
+
+	cursor, moved, err := ms.advanceCursor(userID, partnerID, messageID)
+	if err == ErrDuplicate {
+		// Another request created the cursor between our read
+		// and our write; theirs exists now, so go again.
+		cursor, moved, err = ms.advanceCursor(userID, partnerID, messageID)
+	}
+	return cursor, moved, err
+}
+
+// advanceCursor moves userID's cursor with partnerID up to
+// messageID, creating it if need be.
+func (ms *messageService) advanceCursor(userID, partnerID, messageID uint) (*ReadCursor, bool, error) {
+	cursor, err := ms.ReadCursor(userID, partnerID)
+	switch err {
+	case nil:
+		if cursor.LastReadMessageID >= messageID {
+			return cursor, false, nil
+		}
+	case ErrNotFound:
+		cursor = &ReadCursor{UserID: userID, PartnerID: partnerID}
+	default:
+		return nil, false, err
+	}
+	cursor.LastReadMessageID = messageID
+	if err := ms.SaveReadCursor(cursor); err != nil {
+		return nil, false, err
+	}
+	return cursor, true, nil
+}
+
+func (ms *messageService) Edit(id, userID uint, body string) (*Message, error) {
+	message, err := ms.changeable(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	old := message.Body
+	if strings.TrimSpace(body) == old {
+		return message, nil
+	}
+	now := time.Now()
+	message.Body = body
+	message.EditedAt = &now
+	edit := MessageEdit{MessageID: message.ID, Body: old}
+	if err := ms.SaveEdit(message, &edit); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func (ms *messageService) Retract(id, userID uint) (*Message, error) {
+	message, err := ms.changeable(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := ms.Delete(message.ID); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	message.DeletedAt = &now
+	return message, nil
+}
+
+// changeable looks up message id and makes sure userID may
+// still edit or retract it. Anyone who can't see the message
+// gets ErrNotFound, so only its other participants learn that
+// it exists.
+func (ms *messageService) changeable(id, userID uint) (*Message, error) {
+	message, err := ms.visible(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if message.SenderID != userID {
+		return nil, ErrMessageNotSender
+	}
+	if ms.editWindow > 0 && time.Since(message.CreatedAt) > ms.editWindow {
+		return nil, ErrMessageEditWindow
+	}
+	return message, nil
+}
+
+type messageValidator struct {
+	MessageDB
+	friends       FriendDB
+	conversations ConversationDB
+}
+
+type messageGorm struct {
+	db *gorm.DB
+}
+
+type messageValFunc func(*Message) error
+
+func runMessageValFuncs(message *Message, fns ...messageValFunc) error {
+	for _, fn := range fns {
+		if err := fn(message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewMessageService needs the FriendDB so that it can refuse
+// messages between users who are not friends, and the
+// ConversationDB to refuse messages to groups from people who
+// are not in them. editWindow is how long after sending a
+// message its sender may edit or retract it; zero means
+// forever.
+func NewMessageService(db *gorm.DB, friends FriendDB, conversations ConversationDB, editWindow time.Duration) MessageService {
+	return newMessageService(&messageGorm{db}, friends, conversations, editWindow)
+}
+
+func newMessageService(mdb MessageDB, friends FriendDB, conversations ConversationDB, editWindow time.Duration) MessageService {
+	return &messageService{
+		MessageDB: &messageValidator{
+			MessageDB:     mdb,
+			friends:       friends,
+			conversations: conversations,
+		},
+		friends:       friends,
+		conversations: conversations,
+		editWindow:    editWindow,
+	}
+}
+
+func (mv *messageValidator) Conversation(userID, partnerID, before uint, limit int) ([]Message, error) {
+	if userID <= 0 || partnerID <= 0 {
+		return nil, ErrIDInvalid
+	}
+	return mv.MessageDB.Conversation(userID, partnerID, before, messagePageSize(limit))
+}
+
+func (mv *messageValidator) Group(conversationID, before uint, limit int) ([]Message, error) {
+	if conversationID <= 0 {
+		return nil, ErrIDInvalid
+	}
+	return mv.MessageDB.Group(conversationID, before, messagePageSize(limit))
+}
+
+func (mv *messageValidator) Create(message *Message) error {
+	err := runMessageValFuncs(message,
+		mv.senderIDRequired,
+		mv.oneTarget,
+		mv.notSelf,
+		mv.normalizeBody,
+		mv.bodyRequired,
+		mv.bodyMaxLength,
+		mv.mayPost,
+		mv.quoteParent)
+	if err != nil {
+		return err
+	}
+	return mv.MessageDB.Create(message)
+}
+
+func (mv *messageValidator) Update(message *Message) error {
+	err := runMessageValFuncs(message,
+		mv.senderIDRequired,
+		mv.oneTarget,
+		mv.normalizeBody,
+		mv.bodyRequired,
+		mv.bodyMaxLength)
+	if err != nil {
+		return err
+	}
+	return mv.MessageDB.Update(message)
+}
+
+func (mv *messageValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return mv.MessageDB.Delete(id)
+}
+
+func (mv *messageValidator) senderIDRequired(m *Message) error {
+	if m.SenderID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+// oneTarget makes sure the message is for a user or a group,
+// but not both.
+func (mv *messageValidator) oneTarget(m *Message) error {
+	switch {
+	case m.RecipientID > 0 && m.ConversationID > 0:
+		return ErrMessageTarget
+	case m.RecipientID <= 0 && m.ConversationID <= 0:
+		return ErrRecipientRequired
+	}
+	return nil
+}
+
+func (mv *messageValidator) notSelf(m *Message) error {
+	if m.SenderID == m.RecipientID {
+		return ErrMessageSelf
+	}
+	return nil
+}
+
+func (mv *messageValidator) normalizeBody(m *Message) error {
+	m.Body = strings.TrimSpace(m.Body)
+	return nil
+}
+
+func (mv *messageValidator) bodyRequired(m *Message) error {
+	if m.Body == "" {
+		return ErrBodyRequired
+	}
+	return nil
+}
+
+func (mv *messageValidator) bodyMaxLength(m *Message) error {
+	if utf8.RuneCountInString(m.Body) > messageMaxLength {
+		return ErrBodyTooLong
+	}
+	return nil
+}
+
+// mayPost rejects the message unless the sender is in the
+// group it is for or, for a direct message, the sender and
+// recipient may talk to each other. See canTalk.
+func (mv *messageValidator) mayPost(m *Message) error {
+	if m.ConversationID > 0 {
+		_, err := mv.conversations.Member(m.ConversationID, m.SenderID)
+		return err
+	}
+	return canTalk(mv.friends, m.SenderID, m.RecipientID)
+}
+
+// messagePageSize applies the default and cap to a requested
+// page size.
+func messagePageSize(limit int) int {
+	switch {
+	case limit <= 0:
+		return DefaultMessageLimit
+	case limit > MaxMessageLimit:
+		return MaxMessageLimit
+	}
+	return limit
+}
+
+// canTalk returns ErrNotFriends unless the two users have an
+// accepted friendship in either direction and neither has
+// blocked the other. Blocks are reported as ErrNotFriends so
+// nobody can tell they were blocked.
+func canTalk(friends FriendDB, userID, otherID uint) error {
+	blocked, err := blockedEitherWay(friends, userID, otherID)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return ErrNotFriends
+	}
+	for _, pair := range [][2]uint{
+		{userID, otherID},
+		{otherID, userID},
+	} {
+		friend, err := friends.ByUserAndFriendID(pair[0], pair[1])
+		switch err {
+		case nil:
+			if friend.Status == FriendAccepted {
+				return nil
+			}
+		case ErrNotFound:
+		default:
+			return err
+		}
+	}
+	return ErrNotFriends
+}
+
+func (mg *messageGorm) ByID(id uint) (*Message, error) {
+	var message Message
+	db := mg.db.Where("id = ?", id)
+	err := first(db, &message)
+	return &message, err
+}
+
+func (mg *messageGorm) Conversation(userID, partnerID, before uint, limit int) ([]Message, error) {
+	db := mg.db.Where("(sender_id = ? AND recipient_id = ?) OR (sender_id = ? AND recipient_id = ?)",
+		userID, partnerID, partnerID, userID)
+	return mg.page(db, before, limit)
+}
+
+func (mg *messageGorm) Group(conversationID, before uint, limit int) ([]Message, error) {
+	return mg.page(mg.db.Where("conversation_id = ?", conversationID), before, limit)
+}
+
+// page returns the latest limit messages db matches that are
+// older than before, if it is non-zero, oldest first. Deleted
+// messages are included as tombstones.
+func (mg *messageGorm) page(db *gorm.DB, before uint, limit int) ([]Message, error) {
+	var messages []Message
+	db = db.Unscoped()
+	if before > 0 {
+		db = db.Where("id < ?", before)
+	}
+	err := db.Order("id desc").Limit(limit).Find(&messages).Error
+	if err != nil {
+		return nil, err
+	}
+	// Fetched newest first so the limit keeps the latest page;
+	// flip it so callers can render top to bottom.
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+func (mg *messageGorm) Create(message *Message) error {
+	return mg.db.Create(message).Error
+}
+
+func (mg *messageGorm) Update(message *Message) error {
+	return mg.db.Save(message).Error
+}
+
+func (mg *messageGorm) Delete(id uint) error {
+	message := Message{Model: gorm.Model{ID: id}}
+	return mg.db.Delete(&message).Error
+}
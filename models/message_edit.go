@@ -0,0 +1,62 @@
+package models
+
+import "github.com/jinzhu/gorm"
+
+// MessageEdit is the body a message had before one of its
+// edits; CreatedAt is when it was replaced. Edits are kept for
+// moderation and are never shown to users.
+type MessageEdit struct {
+	gorm.Model
+	MessageID uint   `gorm:"not null;index"`
+	Body      string `gorm:"type:text;not null"`
+}
+
+type MessageEditDB interface {
+	// Edits returns the earlier bodies of messageID, oldest
+	// first.
+	Edits(messageID uint) ([]MessageEdit, error)
+	// SaveEdit updates message and records edit, the body it
+	// replaced, all or nothing.
+	SaveEdit(message *Message, edit *MessageEdit) error
+}
+
+func (mv *messageValidator) Edits(messageID uint) ([]MessageEdit, error) {
+	if messageID <= 0 {
+		return nil, ErrIDInvalid
+	}
+	return mv.MessageDB.Edits(messageID)
+}
+
+// SaveEdit validates message the same way Update does.
+func (mv *messageValidator) SaveEdit(message *Message, edit *MessageEdit) error {
+	if edit.MessageID <= 0 || edit.MessageID != message.ID {
+		return ErrIDInvalid
+	}
+	err := runMessageValFuncs(message,
+		mv.senderIDRequired,
+		mv.oneTarget,
+		mv.normalizeBody,
+		mv.bodyRequired,
+		mv.bodyMaxLength)
+	if err != nil {
+		return err
+	}
+	return mv.MessageDB.SaveEdit(message, edit)
+}
+
+func (mg *messageGorm) Edits(messageID uint) ([]MessageEdit, error) {
+	var edits []MessageEdit
+	err := mg.db.Where("message_id = ?", messageID).
+		Order("id").
+		Find(&edits).Error
+	return edits, err
+}
+
+func (mg *messageGorm) SaveEdit(message *Message, edit *MessageEdit) error {
+	return mg.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(message).Error; err != nil {
+			return err
+		}
+		return tx.Create(edit).Error
+	})
+}
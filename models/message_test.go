@@ -0,0 +1,85 @@
+package models
+
+import "testing"
+
+const (
+	testSender uint = iota + 1
+	testRecipient
+	testStranger
+)
+
+// newTestDM returns a message service on the in-memory stores
+// and a direct message between two friends, stored directly so
+// the test can block either side afterwards.
+func newTestDM(t *testing.T) (MessageService, FriendDB, *Message) {
+	t.Helper()
+	friends := NewMemoryFriendDB()
+	friend := Friend{UserID: testSender, FriendID: testRecipient, Status: FriendAccepted}
+	if err := friends.Create(&friend); err != nil {
+		t.Fatal(err)
+	}
+	mdb := NewMemoryMessageDB()
+	message := Message{SenderID: testSender, RecipientID: testRecipient, Body: "hello"}
+	if err := mdb.Create(&message); err != nil {
+		t.Fatal(err)
+	}
+	return newMessageService(mdb, friends, NewMemoryConversationDB(), 0), friends, &message
+}
+
+// block saves blockerID's block on blockedID directly, since
+// the memory UserDB behind FriendService.Block is empty here.
+func block(t *testing.T, friends FriendDB, blockerID, blockedID uint) {
+	t.Helper()
+	b := Friend{UserID: blockerID, FriendID: blockedID}
+	if existing, err := friends.ByUserAndFriendID(blockerID, blockedID); err == nil {
+		b = *existing
+	}
+	b.Status = FriendBlocked
+	if err := friends.SaveBlock(&b, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReactBlocked(t *testing.T) {
+	ms, friends, message := newTestDM(t)
+	if _, err := ms.React(message.ID, testRecipient, "👍"); err != nil {
+		t.Fatalf("recipient reacts: %v", err)
+	}
+	if _, err := ms.React(message.ID, testStranger, "👍"); err != ErrNotFound {
+		t.Errorf("stranger reacts: err = %v, want ErrNotFound", err)
+	}
+
+	block(t, friends, testSender, testRecipient)
+	for _, id := range []uint{testSender, testRecipient} {
+		if _, err := ms.React(message.ID, id, "🎉"); err != ErrNotFound {
+			t.Errorf("user %d reacts after block: err = %v, want ErrNotFound", id, err)
+		}
+	}
+	if _, err := ms.Unreact(message.ID, testRecipient, "👍"); err != ErrNotFound {
+		t.Errorf("recipient unreacts after block: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestEditVisibility(t *testing.T) {
+	ms, friends, message := newTestDM(t)
+	if _, err := ms.Edit(message.ID, testRecipient, "mine now"); err != ErrMessageNotSender {
+		t.Errorf("recipient edits: err = %v, want ErrMessageNotSender", err)
+	}
+	if _, err := ms.Edit(message.ID, testStranger, "mine now"); err != ErrNotFound {
+		t.Errorf("stranger edits: err = %v, want ErrNotFound", err)
+	}
+	if _, err := ms.Retract(message.ID, testStranger); err != ErrNotFound {
+		t.Errorf("stranger retracts: err = %v, want ErrNotFound", err)
+	}
+	if _, err := ms.Edit(message.ID, testSender, "hello there"); err != nil {
+		t.Fatalf("sender edits: %v", err)
+	}
+
+	block(t, friends, testRecipient, testSender)
+	if _, err := ms.Edit(message.ID, testSender, "hello again"); err != ErrNotFound {
+		t.Errorf("sender edits after block: err = %v, want ErrNotFound", err)
+	}
+	if _, err := ms.Retract(message.ID, testSender); err != ErrNotFound {
+		t.Errorf("sender retracts after block: err = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,528 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// migrationLockID is the Postgres advisory lock key held while
+// migrating, so that replicas starting at the same time take
+// turns instead of racing each other.
+const migrationLockID = 7245937213
+
+// SchemaMigration records that a migration has been applied.
+type SchemaMigration struct {
+	Version   uint      `gorm:"primary_key;auto_increment:false"`
+	Name      string    `gorm:"not null"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+// MigrationStatus describes one migration. AppliedAt is nil if
+// it has not been applied yet.
+type MigrationStatus struct {
+	Version   uint
+	Name      string
+	AppliedAt *time.Time
+}
+
+type migration struct {
+	Version uint
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// migrations is the schema's history, oldest first. Once a
+// migration has shipped it must not change; add a new one
+// instead. Each migration declares its own copy of the structs
+// it creates so that later changes to the models don't rewrite
+// history.
+//
+// The first few use AutoMigrate rather than CreateTable so
+// that databases created before migrations were versioned are
+// adopted as they are.
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "create_users",
+		Up: func(tx *gorm.DB) error {
+			type user struct {
+				gorm.Model
+				Name         string
+				Email        string `gorm:"not null; unique_index"`
+				Handle       string `gorm:"unique_index"`
+				PasswordHash string `gorm:"not null"`
+			}
+			return tx.Table("users").AutoMigrate(&user{}).Error
+		},
+		Down: dropTables("users"),
+	},
+	{
+		Version: 2,
+		Name:    "create_friends",
+		Up: func(tx *gorm.DB) error {
+			type friend struct {
+				gorm.Model
+				UserID   uint   `gorm:"not_null;index"`
+				FriendID uint   `gorm:"not_null"`
+				Status   string `gorm:"not_null"`
+			}
+			return tx.Table("friends").AutoMigrate(&friend{}).Error
+		},
+		Down: dropTables("friends"),
+	},
+	{
+		Version: 3,
+		Name:    "create_messages",
+		Up: func(tx *gorm.DB) error {
+			type message struct {
+				gorm.Model
+				SenderID    uint   `gorm:"not null;index"`
+				RecipientID uint   `gorm:"not null;index"`
+				Body        string `gorm:"type:text;not null"`
+				EditedAt    *time.Time
+			}
+			return tx.Table("messages").AutoMigrate(&message{}).Error
+		},
+		Down: dropTables("messages"),
+	},
+	{
+		Version: 4,
+		Name:    "create_sessions",
+		Up: func(tx *gorm.DB) error {
+			type refreshToken struct {
+				gorm.Model
+				UserID          uint   `gorm:"not null;index"`
+				Family          string `gorm:"not null;index"`
+				TokenHash       string `gorm:"not null;unique_index"`
+				Device          string
+				AccessJTI       string `gorm:"index"`
+				AccessExpiresAt time.Time
+				ExpiresAt       time.Time `gorm:"not null"`
+				UsedAt          *time.Time
+				RevokedAt       *time.Time
+			}
+			type revokedToken struct {
+				gorm.Model
+				JTI       string    `gorm:"not null;unique_index"`
+				ExpiresAt time.Time `gorm:"not null;index"`
+			}
+			if err := tx.Table("refresh_tokens").AutoMigrate(&refreshToken{}).Error; err != nil {
+				return err
+			}
+			return tx.Table("revoked_tokens").AutoMigrate(&revokedToken{}).Error
+		},
+		Down: dropTables("revoked_tokens", "refresh_tokens"),
+	},
+	{
+		Version: 5,
+		Name:    "friends_constraints",
+		Up: func(tx *gorm.DB) error {
+			if err := cleanFriends(tx); err != nil {
+				return err
+			}
+			if tx.Dialect().GetName() == "sqlite3" {
+				return rebuildFriends(tx, true)
+			}
+			return execAll(tx,
+				`ALTER TABLE friends
+					ALTER COLUMN user_id SET NOT NULL,
+					ALTER COLUMN friend_id SET NOT NULL,
+					ALTER COLUMN status SET NOT NULL`,
+				`ALTER TABLE friends ADD CONSTRAINT friends_user_id_fkey
+					FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE`,
+				`ALTER TABLE friends ADD CONSTRAINT friends_friend_id_fkey
+					FOREIGN KEY (friend_id) REFERENCES users (id) ON DELETE CASCADE`,
+				`ALTER TABLE friends ADD CONSTRAINT friends_not_self CHECK (user_id <> friend_id)`,
+				`CREATE UNIQUE INDEX uix_friends_user_id_friend_id ON friends (user_id, friend_id) WHERE deleted_at IS NULL`,
+				`CREATE INDEX idx_friends_friend_id ON friends (friend_id)`,
+			)
+		},
+		Down: func(tx *gorm.DB) error {
+			if tx.Dialect().GetName() == "sqlite3" {
+				return rebuildFriends(tx, false)
+			}
+			return execAll(tx,
+				`DROP INDEX idx_friends_friend_id`,
+				`DROP INDEX uix_friends_user_id_friend_id`,
+				`ALTER TABLE friends DROP CONSTRAINT friends_not_self`,
+				`ALTER TABLE friends DROP CONSTRAINT friends_friend_id_fkey`,
+				`ALTER TABLE friends DROP CONSTRAINT friends_user_id_fkey`,
+				`ALTER TABLE friends
+					ALTER COLUMN user_id DROP NOT NULL,
+					ALTER COLUMN friend_id DROP NOT NULL,
+					ALTER COLUMN status DROP NOT NULL`,
+			)
+		},
+	},
+	{
+		Version: 6,
+		Name:    "add_users_last_seen_at",
+		Up: func(tx *gorm.DB) error {
+			type user struct {
+				LastSeenAt *time.Time
+			}
+			return tx.Table("users").AutoMigrate(&user{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			// The SQLite we build against can't drop columns.
+			// Leaving it behind is harmless since nothing reads
+			// it at this version.
+			if tx.Dialect().GetName() == "sqlite3" {
+				return nil
+			}
+			return tx.Table("users").DropColumn("last_seen_at").Error
+		},
+	},
+	{
+		Version: 7,
+		Name:    "create_read_cursors",
+		Up: func(tx *gorm.DB) error {
+			type readCursor struct {
+				gorm.Model
+				UserID            uint `gorm:"not null"`
+				PartnerID         uint `gorm:"not null"`
+				LastReadMessageID uint `gorm:"not null"`
+			}
+			if err := tx.Table("read_cursors").CreateTable(&readCursor{}).Error; err != nil {
+				return err
+			}
+			return tx.Exec(`CREATE UNIQUE INDEX uix_read_cursors_user_id_partner_id
+				ON read_cursors (user_id, partner_id) WHERE deleted_at IS NULL`).Error
+		},
+		Down: dropTables("read_cursors"),
+	},
+	{
+		Version: 8,
+		Name:    "create_conversations",
+		Up: func(tx *gorm.DB) error {
+			type conversation struct {
+				gorm.Model
+				Name string `gorm:"not null"`
+			}
+			type conversationMember struct {
+				gorm.Model
+				ConversationID uint      `gorm:"not null;index"`
+				UserID         uint      `gorm:"not null;index"`
+				Role           string    `gorm:"not null"`
+				JoinedAt       time.Time `gorm:"not null"`
+				Muted          bool      `gorm:"not null"`
+			}
+			type message struct {
+				ConversationID uint `gorm:"not null;default:0;index"`
+			}
+			if err := tx.Table("conversations").CreateTable(&conversation{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Table("conversation_members").CreateTable(&conversationMember{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Exec(`CREATE UNIQUE INDEX uix_conversation_members_conversation_id_user_id
+				ON conversation_members (conversation_id, user_id) WHERE deleted_at IS NULL`).Error; err != nil {
+				return err
+			}
+			return tx.Table("messages").AutoMigrate(&message{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropTables("conversation_members", "conversations")(tx); err != nil {
+				return err
+			}
+			// As with add_users_last_seen_at, SQLite keeps the
+			// column; every row left in it is a direct message
+			// with a zero conversation_id.
+			if tx.Dialect().GetName() == "sqlite3" {
+				return nil
+			}
+			return tx.Table("messages").DropColumn("conversation_id").Error
+		},
+	},
+	{
+		Version: 9,
+		Name:    "create_message_edits",
+		Up: func(tx *gorm.DB) error {
+			type messageEdit struct {
+				gorm.Model
+				MessageID uint   `gorm:"not null;index"`
+				Body      string `gorm:"type:text;not null"`
+			}
+			return tx.Table("message_edits").CreateTable(&messageEdit{}).Error
+		},
+		Down: dropTables("message_edits"),
+	},
+	{
+		Version: 10,
+		Name:    "create_reactions",
+		Up: func(tx *gorm.DB) error {
+			type reaction struct {
+				gorm.Model
+				MessageID uint   `gorm:"not null;index"`
+				UserID    uint   `gorm:"not null"`
+				Emoji     string `gorm:"not null"`
+			}
+			if err := tx.Table("reactions").CreateTable(&reaction{}).Error; err != nil {
+				return err
+			}
+			return tx.Exec(`CREATE UNIQUE INDEX uix_reactions_message_id_user_id_emoji
+				ON reactions (message_id, user_id, emoji) WHERE deleted_at IS NULL`).Error
+		},
+		Down: dropTables("reactions"),
+	},
+	{
+		Version: 11,
+		Name:    "add_messages_parent_id",
+		Up: func(tx *gorm.DB) error {
+			type message struct {
+				ParentID      uint   `gorm:"not null;default:0;index"`
+				QuoteSenderID uint   `gorm:"not null;default:0"`
+				QuoteBody     string `gorm:"type:text;not null;default:''"`
+			}
+			return tx.Table("messages").AutoMigrate(&message{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if tx.Dialect().GetName() == "sqlite3" {
+				return nil
+			}
+			return execAll(tx,
+				`ALTER TABLE messages DROP COLUMN quote_body`,
+				`ALTER TABLE messages DROP COLUMN quote_sender_id`,
+				`ALTER TABLE messages DROP COLUMN parent_id`,
+			)
+		},
+	},
+}
+
+func dropTables(tables ...string) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		for _, table := range tables {
+			if err := tx.DropTableIfExists(table).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func execAll(tx *gorm.DB, statements ...string) error {
+	for _, stmt := range statements {
+		if err := tx.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanFriends gets rid of the rows the friends constraints
+// would reject: rows pointing at users that don't exist, rows
+// from a user to themselves, and all but the oldest of any
+// live duplicates.
+func cleanFriends(tx *gorm.DB) error {
+	return execAll(tx,
+		`DELETE FROM friends
+			WHERE user_id IS NULL OR friend_id IS NULL OR status IS NULL
+			OR user_id = friend_id
+			OR user_id NOT IN (SELECT id FROM users)
+			OR friend_id NOT IN (SELECT id FROM users)`,
+		`UPDATE friends SET deleted_at = CURRENT_TIMESTAMP
+			WHERE deleted_at IS NULL AND id NOT IN (
+				SELECT MIN(id) FROM friends WHERE deleted_at IS NULL GROUP BY user_id, friend_id
+			)`,
+	)
+}
+
+// rebuildFriends recreates the friends table with or without
+// its constraints. SQLite can't add constraints to an existing
+// table, so the rows are copied into a new one instead.
+func rebuildFriends(tx *gorm.DB, constrained bool) error {
+	columns := `
+		id integer primary key autoincrement,
+		created_at datetime,
+		updated_at datetime,
+		deleted_at datetime,
+		user_id integer,
+		friend_id integer,
+		status varchar(255)`
+	indexes := []string{
+		`CREATE INDEX idx_friends_deleted_at ON friends (deleted_at)`,
+		`CREATE INDEX idx_friends_user_id ON friends (user_id)`,
+	}
+	if constrained {
+		columns = `
+		id integer primary key autoincrement,
+		created_at datetime,
+		updated_at datetime,
+		deleted_at datetime,
+		user_id integer NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		friend_id integer NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		status varchar(255) NOT NULL,
+		CONSTRAINT friends_not_self CHECK (user_id <> friend_id)`
+		indexes = append(indexes,
+			`CREATE UNIQUE INDEX uix_friends_user_id_friend_id ON friends (user_id, friend_id) WHERE deleted_at IS NULL`,
+			`CREATE INDEX idx_friends_friend_id ON friends (friend_id)`,
+		)
+	}
+	return execAll(tx, append([]string{
+		`CREATE TABLE friends_new (` + columns + `)`,
+		`INSERT INTO friends_new (id, created_at, updated_at, deleted_at, user_id, friend_id, status)
+			SELECT id, created_at, updated_at, deleted_at, user_id, friend_id, status FROM friends`,
+		`DROP TABLE friends`,
+		`ALTER TABLE friends_new RENAME TO friends`,
+	}, indexes...)...)
+}
+
+// MigrateUp applies every migration that hasn't been applied
+// yet, in order, and returns the ones it applied. It is a no-op
+// without WithGorm.
+func (s *Services) MigrateUp() ([]MigrationStatus, error) {
+	var done []MigrationStatus
+	err := s.migrate(func(tx *gorm.DB, applied map[uint]SchemaMigration) error {
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			status, err := up(tx, m)
+			if err != nil {
+				return err
+			}
+			done = append(done, *status)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// MigrateDown rolls back the most recently applied migration
+// and returns it, or nil if nothing was applied.
+func (s *Services) MigrateDown() (*MigrationStatus, error) {
+	var done *MigrationStatus
+	err := s.migrate(func(tx *gorm.DB, applied map[uint]SchemaMigration) error {
+		m, ok := latest(applied)
+		if !ok {
+			return nil
+		}
+		var err error
+		done, err = down(tx, m)
+		return err
+	})
+	return done, err
+}
+
+// MigrateRedo rolls back the most recently applied migration
+// and applies it again, which is handy while writing one.
+func (s *Services) MigrateRedo() (*MigrationStatus, error) {
+	var done *MigrationStatus
+	err := s.migrate(func(tx *gorm.DB, applied map[uint]SchemaMigration) error {
+		m, ok := latest(applied)
+		if !ok {
+			return nil
+		}
+		if _, err := down(tx, m); err != nil {
+			return err
+		}
+		var err error
+		done, err = up(tx, m)
+		return err
+	})
+	return done, err
+}
+
+// Migrations lists every known migration and whether it has
+// been applied.
+func (s *Services) Migrations() ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+	err := s.migrate(func(tx *gorm.DB, applied map[uint]SchemaMigration) error {
+		for _, m := range migrations {
+			status := MigrationStatus{Version: m.Version, Name: m.Name}
+			if a, ok := applied[m.Version]; ok {
+				status.AppliedAt = &a.AppliedAt
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// DestructiveReset rolls back every migration, dropping all
+// tables, and applies them again.
+func (s *Services) DestructiveReset() error {
+	err := s.migrate(func(tx *gorm.DB, applied map[uint]SchemaMigration) error {
+		for i := len(migrations) - 1; i >= 0; i-- {
+			if _, ok := applied[migrations[i].Version]; !ok {
+				continue
+			}
+			if _, err := down(tx, migrations[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.MigrateUp()
+	return err
+}
+
+// migrate runs fn in a transaction holding the migration lock,
+// with the migrations applied so far keyed by version. Postgres
+// and SQLite can both roll back schema changes, so a failed
+// migration leaves nothing half done.
+func (s *Services) migrate(fn func(tx *gorm.DB, applied map[uint]SchemaMigration) error) error {
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		// SQLite has no advisory locks, but it only lets one
+		// writer in at a time anyway.
+		if tx.Dialect().GetName() == "postgres" {
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationLockID).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.AutoMigrate(&SchemaMigration{}).Error; err != nil {
+			return err
+		}
+		var rows []SchemaMigration
+		if err := tx.Find(&rows).Error; err != nil {
+			return err
+		}
+		applied := make(map[uint]SchemaMigration, len(rows))
+		for _, row := range rows {
+			applied[row.Version] = row
+		}
+		return fn(tx, applied)
+	})
+}
+
+func up(tx *gorm.DB, m migration) (*MigrationStatus, error) {
+	if err := m.Up(tx); err != nil {
+		return nil, err
+	}
+	row := SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}
+	if err := tx.Create(&row).Error; err != nil {
+		return nil, err
+	}
+	return &MigrationStatus{Version: m.Version, Name: m.Name, AppliedAt: &row.AppliedAt}, nil
+}
+
+func down(tx *gorm.DB, m migration) (*MigrationStatus, error) {
+	if err := m.Down(tx); err != nil {
+		return nil, err
+	}
+	if err := tx.Where("version = ?", m.Version).Delete(&SchemaMigration{}).Error; err != nil {
+		return nil, err
+	}
+	return &MigrationStatus{Version: m.Version, Name: m.Name}, nil
+}
+
+// latest returns the newest known migration that has been
+// applied.
+func latest(applied map[uint]SchemaMigration) (migration, bool) {
+	for i := len(migrations) - 1; i >= 0; i-- {
+		if _, ok := applied[migrations[i].Version]; ok {
+			return migrations[i], true
+		}
+	}
+	return migration{}, false
+}
@@ -0,0 +1,37 @@
+package models
+
+import "testing"
+
+const testPepper = "test-pepper"
+
+// newSQLiteServices returns user and friend services backed by
+// a migrated, in-memory SQLite database. The pool is held to
+// one connection since each new connection to ":memory:" opens
+// a new, empty database.
+func newSQLiteServices(t *testing.T) *Services {
+	t.Helper()
+	s, err := NewServices(
+		WithGorm("sqlite3", ":memory:?_foreign_keys=1", ConnPool{MaxOpenConns: 1, MaxIdleConns: 1}),
+		WithLogMode(false),
+		WithUser(testPepper),
+		WithFriend())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if _, err := s.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// mustCreateUser stores a user with the given email and handle
+// directly in udb, bypassing validation.
+func mustCreateUser(t *testing.T, udb UserDB, email, handle string) *User {
+	t.Helper()
+	user := User{Name: handle, Email: email, Handle: handle, PasswordHash: "hash"}
+	if err := udb.Create(&user); err != nil {
+		t.Fatalf("create %s: %v", email, err)
+	}
+	return &user
+}
@@ -0,0 +1,238 @@
+package models
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// PresenceAwayAfter is how long a connected user can go
+	// without an active heartbeat before they show as away.
+	PresenceAwayAfter = 5 * time.Minute
+	// presenceSweepEvery is how often we look for users who
+	// have gone idle.
+	presenceSweepEvery = 30 * time.Second
+)
+
+// PresenceStatus is whether a user is around.
+type PresenceStatus string
+
+const (
+	PresenceOnline  PresenceStatus = "online"
+	PresenceAway    PresenceStatus = "away"
+	PresenceOffline PresenceStatus = "offline"
+)
+
+// Presence is the data of a "presence.changed" event, and one
+// entry of a presence snapshot. LastSeenAt is only set for
+// users who are offline.
+type Presence struct {
+	UserID     uint           `json:"user_id"`
+	Status     PresenceStatus `json:"status"`
+	LastSeenAt *time.Time     `json:"last_seen_at,omitempty"`
+}
+
+// PresenceHeartbeat is the data of the "presence.heartbeat"
+// event clients send every so often. Active says whether the
+// user has done anything since the last one.
+type PresenceHeartbeat struct {
+	Active bool `json:"active"`
+}
+
+// PresenceService tracks who is online from the socket hub and
+// tells each user's accepted friends when that changes. A user
+// is online while they have at least one connection open and
+// have been active within PresenceAwayAfter, away while
+// connected but idle, and offline otherwise.
+type PresenceService interface {
+	// Friends returns the presence of every accepted friend of
+	// userID.
+	Friends(userID uint) ([]Presence, error)
+	// Close stops looking for idle users.
+	Close() error
+}
+
+type presenceService struct {
+	sockets SocketService
+	friends FriendDB
+	users   UserDB
+
+	mu    sync.Mutex
+	state map[uint]*presenceState
+	stop  chan struct{}
+	once  sync.Once
+}
+
+// presenceState is what we know about a connected user.
+type presenceState struct {
+	conns      int
+	status     PresenceStatus
+	lastActive time.Time
+}
+
+// NewPresenceService hooks into sockets to see users come and
+// go and to receive their heartbeats. It needs friends to know
+// who to tell, and users to record when they were last seen.
+func NewPresenceService(sockets SocketService, friends FriendDB, users UserDB) PresenceService {
+	ps := &presenceService{
+		sockets: sockets,
+		friends: friends,
+		users:   users,
+		state:   make(map[uint]*presenceState),
+		stop:    make(chan struct{}),
+	}
+	sockets.OnConnect(ps.connected)
+	sockets.OnDisconnect(ps.disconnected)
+	sockets.Handle("presence.heartbeat", ps.heartbeat)
+	go ps.sweep()
+	return ps
+}
+
+func (ps *presenceService) Friends(userID uint) ([]Presence, error) {
+	ids, err := ps.friendIDs(userID)
+	if err != nil {
+		return nil, err
+	}
+	users, err := ps.users.ByIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	presences := make([]Presence, 0, len(users))
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, u := range users {
+		p := Presence{UserID: u.ID, Status: PresenceOffline, LastSeenAt: u.LastSeenAt}
+		if st, ok := ps.state[u.ID]; ok {
+			p.Status = st.status
+			p.LastSeenAt = nil
+		}
+		presences = append(presences, p)
+	}
+	return presences, nil
+}
+
+func (ps *presenceService) Close() error {
+	ps.once.Do(func() { close(ps.stop) })
+	return nil
+}
+
+func (ps *presenceService) connected(userID uint) {
+	ps.mu.Lock()
+	st, ok := ps.state[userID]
+	if !ok {
+		st = &presenceState{status: PresenceOffline}
+		ps.state[userID] = st
+	}
+	st.conns++
+	st.lastActive = time.Now()
+	changed := st.status != PresenceOnline
+	st.status = PresenceOnline
+	ps.mu.Unlock()
+
+	if changed {
+		ps.announce(Presence{UserID: userID, Status: PresenceOnline})
+	}
+}
+
+func (ps *presenceService) disconnected(userID uint) {
+	ps.mu.Lock()
+	st, ok := ps.state[userID]
+	if !ok {
+		ps.mu.Unlock()
+		return
+	}
+	st.conns--
+	if st.conns > 0 {
+		ps.mu.Unlock()
+		return
+	}
+	delete(ps.state, userID)
+	ps.mu.Unlock()
+
+	now := time.Now()
+	if err := ps.users.SetLastSeen(userID, now); err != nil {
+		log.Println("presence: last seen:", err)
+	}
+	ps.announce(Presence{UserID: userID, Status: PresenceOffline, LastSeenAt: &now})
+}
+
+func (ps *presenceService) heartbeat(userID uint, data json.RawMessage) {
+	var hb PresenceHeartbeat
+	if err := json.Unmarshal(data, &hb); err != nil || !hb.Active {
+		return
+	}
+	ps.mu.Lock()
+	st, ok := ps.state[userID]
+	if !ok {
+		ps.mu.Unlock()
+		return
+	}
+	st.lastActive = time.Now()
+	changed := st.status != PresenceOnline
+	st.status = PresenceOnline
+	ps.mu.Unlock()
+
+	if changed {
+		ps.announce(Presence{UserID: userID, Status: PresenceOnline})
+	}
+}
+
+// sweep marks users away once they have been idle for
+// PresenceAwayAfter.
+func (ps *presenceService) sweep() {
+	ticker := time.NewTicker(presenceSweepEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ps.stop:
+			return
+		case now := <-ticker.C:
+			var away []uint
+			ps.mu.Lock()
+			for id, st := range ps.state {
+				if st.status == PresenceOnline && now.Sub(st.lastActive) >= PresenceAwayAfter {
+					st.status = PresenceAway
+					away = append(away, id)
+				}
+			}
+			ps.mu.Unlock()
+			for _, id := range away {
+				ps.announce(Presence{UserID: id, Status: PresenceAway})
+			}
+		}
+	}
+}
+
+// announce sends p to the accepted friends of the user it is
+// about. Blocking someone severs the friendship, so blocked
+// users never hear about the blocker.
+func (ps *presenceService) announce(p Presence) {
+	ids, err := ps.friendIDs(p.UserID)
+	if err != nil {
+		log.Println("presence: friends:", err)
+		return
+	}
+	event := SocketEvent{Type: "presence.changed", Data: p}
+	for _, id := range ids {
+		if err := ps.sockets.Send(id, event); err != nil && err != ErrSocketClosed {
+			log.Println("presence: send:", err)
+		}
+	}
+}
+
+// friendIDs returns the IDs of userID's accepted friends.
+func (ps *presenceService) friendIDs(userID uint) ([]uint, error) {
+	rows, err := ps.friends.ByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	ids := []uint{}
+	for _, f := range rows {
+		if f.Status == FriendAccepted {
+			ids = append(ids, f.FriendID)
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,183 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Reaction is UserID reacting to MessageID with Emoji. The
+// database allows at most one live row per (MessageID, UserID,
+// Emoji), so a user can react with several different emoji but
+// each only once.
+type Reaction struct {
+	gorm.Model
+	MessageID uint   `gorm:"not null;index"`
+	UserID    uint   `gorm:"not null"`
+	Emoji     string `gorm:"not null"`
+}
+
+// ReactionCount is how many people reacted to a message with
+// Emoji, and whether the user asking was one of them.
+type ReactionCount struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count"`
+	Reacted bool   `json:"reacted"`
+}
+
+type ReactionDB interface {
+	// Reaction returns userID's reaction to messageID with
+	// emoji, or ErrNotFound.
+	Reaction(messageID, userID uint, emoji string) (*Reaction, error)
+	CreateReaction(reaction *Reaction) error
+	DeleteReaction(id uint) error
+	// ReactionCounts returns the reactions to each of
+	// messageIDs, in the order each emoji was first used.
+	// Reacted is set on the ones userID is part of. Messages
+	// nobody reacted to are left out.
+	ReactionCounts(messageIDs []uint, userID uint) (map[uint][]ReactionCount, error)
+}
+
+func (ms *messageService) React(messageID, userID uint, emoji string) (*Reaction, error) {
+	if _, err := ms.visible(messageID, userID); err != nil {
+		return nil, err
+	}
+	reaction := Reaction{
+		MessageID: messageID,
+		UserID:    userID,
+		Emoji:     emoji,
+	}
+	if err := ms.CreateReaction(&reaction); err != nil {
+		return nil, err
+	}
+	return &reaction, nil
+}
+
+func (ms *messageService) Unreact(messageID, userID uint, emoji string) (*Reaction, error) {
+	if _, err := ms.visible(messageID, userID); err != nil {
+		return nil, err
+	}
+	reaction, err := ms.Reaction(messageID, userID, strings.TrimSpace(emoji))
+	if err != nil {
+		return nil, err
+	}
+	if err := ms.DeleteReaction(reaction.ID); err != nil {
+		return nil, err
+	}
+	return reaction, nil
+}
+
+// visible looks up message id and makes sure userID can see
+// it.
+func (ms *messageService) visible(id, userID uint) (*Message, error) {
+	message, err := ms.ByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := ms.canSee(message, userID); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// canSee returns ErrNotFound unless userID sent or received
+// message, or is in the group it was sent to. A block between
+// the two sides of a direct message hides it as well.
+func (ms *messageService) canSee(message *Message, userID uint) error {
+	if message.ConversationID > 0 {
+		_, err := ms.conversations.Member(message.ConversationID, userID)
+		return err
+	}
+	otherID := message.SenderID
+	switch userID {
+	case message.SenderID:
+		otherID = message.RecipientID
+	case message.RecipientID:
+	default:
+		return ErrNotFound
+	}
+	blocked, err := blockedEitherWay(ms.friends, userID, otherID)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (mv *messageValidator) Reaction(messageID, userID uint, emoji string) (*Reaction, error) {
+	if messageID <= 0 || userID <= 0 {
+		return nil, ErrIDInvalid
+	}
+	return mv.MessageDB.Reaction(messageID, userID, emoji)
+}
+
+func (mv *messageValidator) CreateReaction(reaction *Reaction) error {
+	if reaction.MessageID <= 0 {
+		return ErrIDInvalid
+	}
+	if reaction.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	reaction.Emoji = strings.TrimSpace(reaction.Emoji)
+	if !validEmoji(reaction.Emoji) {
+		return ErrEmojiInvalid
+	}
+	return mv.MessageDB.CreateReaction(reaction)
+}
+
+func (mv *messageValidator) DeleteReaction(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return mv.MessageDB.DeleteReaction(id)
+}
+
+func (mg *messageGorm) Reaction(messageID, userID uint, emoji string) (*Reaction, error) {
+	var reaction Reaction
+	db := mg.db.Where("message_id = ? AND user_id = ? AND emoji = ?", messageID, userID, emoji)
+	err := first(db, &reaction)
+	return &reaction, err
+}
+
+func (mg *messageGorm) CreateReaction(reaction *Reaction) error {
+	err := mg.db.Create(reaction).Error
+	if violated(err) == constraintUnique {
+		return ErrReactionExists
+	}
+	return err
+}
+
+func (mg *messageGorm) DeleteReaction(id uint) error {
+	reaction := Reaction{Model: gorm.Model{ID: id}}
+	return mg.db.Delete(&reaction).Error
+}
+
+func (mg *messageGorm) ReactionCounts(messageIDs []uint, userID uint) (map[uint][]ReactionCount, error) {
+	counts := make(map[uint][]ReactionCount)
+	if len(messageIDs) == 0 {
+		return counts, nil
+	}
+	rows, err := mg.db.Table("reactions").
+		Select("message_id, emoji, COUNT(*), MAX(CASE WHEN user_id = ? THEN 1 ELSE 0 END)", userID).
+		Where("message_id IN (?) AND deleted_at IS NULL", messageIDs).
+		Group("message_id, emoji").
+		Order("MIN(id)").
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var messageID uint
+		var count ReactionCount
+		var reacted int
+		if err := rows.Scan(&messageID, &count.Emoji, &count.Count, &reacted); err != nil {
+			return nil, err
+		}
+		count.Reacted = reacted == 1
+		counts[messageID] = append(counts[messageID], count)
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,80 @@
+package models
+
+import "github.com/jinzhu/gorm"
+
+// ReadCursor is how far UserID has read their conversation
+// with PartnerID. Every message in it with an ID up to
+// LastReadMessageID counts as seen.
+type ReadCursor struct {
+	gorm.Model
+	UserID            uint `gorm:"not null"`
+	PartnerID         uint `gorm:"not null"`
+	LastReadMessageID uint `gorm:"not null"`
+}
+
+type ReadCursorDB interface {
+	// ReadCursor returns userID's cursor in the conversation
+	// with partnerID, or ErrNotFound if they never read it.
+	ReadCursor(userID, partnerID uint) (*ReadCursor, error)
+	// SaveReadCursor creates or updates cursor. Creating a
+	// second cursor for the same pair is ErrDuplicate.
+	SaveReadCursor(cursor *ReadCursor) error
+	// UnreadCounts returns, for each user who has sent userID
+	// messages past userID's read cursor, how many there are.
+	// Users with nothing unread are left out.
+	UnreadCounts(userID uint) (map[uint]int, error)
+}
+
+func (mv *messageValidator) ReadCursor(userID, partnerID uint) (*ReadCursor, error) {
+	if userID <= 0 || partnerID <= 0 {
+		return nil, ErrIDInvalid
+	}
+	return mv.MessageDB.ReadCursor(userID, partnerID)
+}
+
+func (mv *messageValidator) SaveReadCursor(cursor *ReadCursor) error {
+	if cursor.UserID <= 0 || cursor.PartnerID <= 0 {
+		return ErrIDInvalid
+	}
+	return mv.MessageDB.SaveReadCursor(cursor)
+}
+
+func (mg *messageGorm) ReadCursor(userID, partnerID uint) (*ReadCursor, error) {
+	var cursor ReadCursor
+	db := mg.db.Where("user_id = ? AND partner_id = ?", userID, partnerID)
+	err := first(db, &cursor)
+	return &cursor, err
+}
+
+func (mg *messageGorm) SaveReadCursor(cursor *ReadCursor) error {
+	err := mg.db.Save(cursor).Error
+	if violated(err) == constraintUnique {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (mg *messageGorm) UnreadCounts(userID uint) (map[uint]int, error) {
+	rows, err := mg.db.Table("messages").
+		Select("messages.sender_id, COUNT(*)").
+		Joins("LEFT JOIN read_cursors ON read_cursors.user_id = messages.recipient_id "+
+			"AND read_cursors.partner_id = messages.sender_id AND read_cursors.deleted_at IS NULL").
+		Where("messages.recipient_id = ? AND messages.deleted_at IS NULL", userID).
+		Where("messages.id > COALESCE(read_cursors.last_read_message_id, 0)").
+		Group("messages.sender_id").
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[uint]int)
+	for rows.Next() {
+		var senderID uint
+		var count int
+		if err := rows.Scan(&senderID, &count); err != nil {
+			return nil, err
+		}
+		counts[senderID] = count
+	}
+	return counts, rows.Err()
+}
@@ -1,24 +1,50 @@
 package models
 
 import (
+	"context"
+	"time"
+
 	"github.com/jinzhu/gorm"
 )
 
 type ServicesConfig func(*Services) error
 
 type Services struct {
-	User   UserService
-	Friend FriendService
-	// Socket SocketService
-	db *gorm.DB
+	User         UserService
+	Session      SessionService
+	Friend       FriendService
+	Conversation ConversationService
+	Message      MessageService
+	Socket       SocketService
+	Presence     PresenceService
+	Typing       TypingService
+	db           *gorm.DB
+}
+
+// ConnPool sizes the sql.DB that gorm wraps. Zero values leave
+// the database/sql defaults in place.
+type ConnPool struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
 }
 
-func WithGorm(dialect, dbInfo string) ServicesConfig {
+func WithGorm(dialect, dbInfo string, pool ConnPool) ServicesConfig {
 	return func(s *Services) error {
 		db, err := gorm.Open(dialect, dbInfo)
 		if err != nil {
 			return err
 		}
+		sqlDB := db.DB()
+		if pool.MaxOpenConns > 0 {
+			sqlDB.SetMaxOpenConns(pool.MaxOpenConns)
+		}
+		if pool.MaxIdleConns > 0 {
+			sqlDB.SetMaxIdleConns(pool.MaxIdleConns)
+		}
+		if pool.ConnMaxLifetime > 0 {
+			sqlDB.SetConnMaxLifetime(pool.ConnMaxLifetime)
+		}
 		s.db = db
 		return nil
 	}
@@ -31,16 +57,103 @@ func WithLogMode(mode bool) ServicesConfig {
 	}
 }
 
-func WithUser(pepper, jwtSecret string) ServicesConfig {
+func WithUser(pepper string) ServicesConfig {
+	return func(s *Services) error {
+		s.User = NewUserService(s.db, pepper)
+		return nil
+	}
+}
+
+func WithSession() ServicesConfig {
 	return func(s *Services) error {
-		s.User = NewUserService(s.db, pepper, jwtSecret)
+		s.Session = NewSessionService(s.db)
 		return nil
 	}
 }
 
+// WithFriend must come after WithUser since friend requests
+// are addressed by email address or name.
 func WithFriend() ServicesConfig {
 	return func(s *Services) error {
-		s.Friend = NewFriendService(s.db)
+		s.Friend = NewFriendService(s.db, s.User)
+		return nil
+	}
+}
+
+// WithConversation must come after WithFriend since groups are
+// made up of friends.
+func WithConversation() ServicesConfig {
+	return func(s *Services) error {
+		s.Conversation = NewConversationService(s.db, s.Friend)
+		return nil
+	}
+}
+
+// WithMessage must come after WithFriend and WithConversation
+// since messages are only allowed between friends and within
+// groups the sender is in. editWindow is how long senders can
+// edit or delete their messages for; zero means forever.
+func WithMessage(editWindow time.Duration) ServicesConfig {
+	return func(s *Services) error {
+		s.Message = NewMessageService(s.db, s.Friend, s.Conversation, editWindow)
+		return nil
+	}
+}
+
+// WithMemoryUser, WithMemoryFriend, WithMemoryConversation and
+// WithMemoryMessage are the in-memory counterparts of
+// WithUser, WithFriend, WithConversation and WithMessage, and
+// have the same ordering requirements. They don't need
+// WithGorm, so tests can build Services without a database.
+func WithMemoryUser(pepper string) ServicesConfig {
+	return func(s *Services) error {
+		s.User = newUserService(NewMemoryUserDB(), pepper)
+		return nil
+	}
+}
+
+func WithMemoryFriend() ServicesConfig {
+	return func(s *Services) error {
+		s.Friend = newFriendService(NewMemoryFriendDB(), s.User)
+		return nil
+	}
+}
+
+func WithMemoryConversation() ServicesConfig {
+	return func(s *Services) error {
+		s.Conversation = newConversationService(NewMemoryConversationDB(), s.Friend)
+		return nil
+	}
+}
+
+func WithMemoryMessage(editWindow time.Duration) ServicesConfig {
+	return func(s *Services) error {
+		s.Message = newMessageService(NewMemoryMessageDB(), s.Friend, s.Conversation, editWindow)
+		return nil
+	}
+}
+
+func WithSocket() ServicesConfig {
+	return func(s *Services) error {
+		s.Socket = NewSocketService()
+		return nil
+	}
+}
+
+// WithPresence must come after WithUser, WithFriend and
+// WithSocket since it watches the socket hub and tells friends
+// about each other.
+func WithPresence() ServicesConfig {
+	return func(s *Services) error {
+		s.Presence = NewPresenceService(s.Socket, s.Friend, s.User)
+		return nil
+	}
+}
+
+// WithTyping must come after WithFriend and WithSocket.
+func WithTyping() ServicesConfig {
+	return func(s *Services) error {
+		s.Typing = NewTypingService(s.Socket, s.Friend)
 		return nil
 	}
 }
@@ -55,20 +168,31 @@ func NewServices(cfgs ...ServicesConfig) (*Services, error) {
 	return &s, nil
 }
 
-func (s *Services) Close() error {
-	// also close socket service and user service?
-	return s.db.Close()
-}
-
-// DestructiveReset drops all tables and rebuilds them
-func (s *Services) DestructiveReset() error {
-	err := s.db.DropTableIfExists(&User{}).Error
-	if err != nil {
+// Shutdown drains the socket hub before closing the database
+// so nothing queued for delivery is lost. If ctx runs out
+// before the hub has drained, the database is closed anyway and
+// ctx's error is returned.
+func (s *Services) Shutdown(ctx context.Context) error {
+	var sockErr error
+	if s.Socket != nil {
+		sockErr = s.Socket.Shutdown(ctx)
+	}
+	if s.Presence != nil {
+		s.Presence.Close()
+	}
+	if s.Typing != nil {
+		s.Typing.Close()
+	}
+	if s.db == nil {
+		return sockErr
+	}
+	if err := s.db.Close(); err != nil {
 		return err
 	}
-	return s.AutoMigrate()
+	return sockErr
 }
 
-func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&User{}, &Friend{}).Error
+// Close is Shutdown without a deadline.
+func (s *Services) Close() error {
+	return s.Shutdown(context.Background())
 }
@@ -0,0 +1,416 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"sockets/rand"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// RefreshTokenBytes is how many random bytes go into a
+	// refresh token.
+	RefreshTokenBytes = 32
+	// RefreshTokenTTL is how long a refresh token can be used
+	// for. Every use hands out a new one, so a session only
+	// ends after this long without the app being opened.
+	RefreshTokenTTL = 30 * 24 * time.Hour
+	// revokedPruneEvery is how often refreshing also clears
+	// out revocations of access tokens that have expired.
+	revokedPruneEvery = time.Hour
+)
+
+// RefreshToken is one link in a session's chain of refresh
+// tokens. Logging in starts a new Family (one per device), and
+// every refresh marks the current token used and adds the next
+// one to the same Family. Only a hash of the token is stored.
+type RefreshToken struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null;index"`
+	Family    string `gorm:"not null;index"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+	Device    string
+	// AccessJTI and AccessExpiresAt describe the access token
+	// handed out alongside this refresh token, so that ending
+	// the session can revoke it too.
+	AccessJTI       string `gorm:"index"`
+	AccessExpiresAt time.Time
+	ExpiresAt       time.Time `gorm:"not null"`
+	UsedAt          *time.Time
+	RevokedAt       *time.Time
+}
+
+// RevokedToken is an access token that must no longer be
+// accepted even though it has not expired. Rows are only
+// useful until ExpiresAt, after which they are pruned.
+type RevokedToken struct {
+	gorm.Model
+	JTI       string    `gorm:"not null;unique_index"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+type SessionService interface {
+	// Start opens a new session for userID on device and
+	// returns its first refresh token. accessJTI and
+	// accessExpiresAt describe the access token issued with it.
+	Start(userID uint, device, accessJTI string, accessExpiresAt time.Time) (*RefreshToken, error)
+	// Rotate exchanges token for the next refresh token in the
+	// same session. Presenting a token that was already used
+	// means it was stolen, so the whole session is revoked and
+	// ErrTokenReused is returned.
+	Rotate(token, accessJTI string, accessExpiresAt time.Time) (*RefreshToken, error)
+	// End revokes the session that access token accessJTI was
+	// issued in, along with the access token itself.
+	End(accessJTI string, accessExpiresAt time.Time) error
+	// EndAll revokes every session userID has open.
+	EndAll(userID uint) error
+	// IsRevoked reports whether the access token jti has been
+	// revoked.
+	IsRevoked(jti string) (bool, error)
+}
+
+type SessionDB interface {
+	ByTokenHash(hash string) (*RefreshToken, error)
+	ByAccessJTI(jti string) (*RefreshToken, error)
+	// Active returns every refresh token of userID that has not
+	// been used, revoked or expired.
+	Active(userID uint) ([]RefreshToken, error)
+	Create(token *RefreshToken) error
+	Update(token *RefreshToken) error
+	// Exchange marks current used, revokes the access token
+	// issued with it and creates next, all or nothing. If
+	// current was used or revoked in the meantime nothing is
+	// written and ErrTokenReused is returned, so only one of
+	// several concurrent refreshes with the same token wins.
+	Exchange(current, next *RefreshToken) error
+	// RevokeFamily marks every token in family as revoked and
+	// revokes the access tokens issued with them.
+	RevokeFamily(family string) error
+	RevokeJTI(jti string, expiresAt time.Time) error
+	IsRevoked(jti string) (bool, error)
+	// PruneRevoked deletes the revoked access tokens that
+	// expired before t.
+	PruneRevoked(t time.Time) error
+}
+
+type sessionService struct {
+	SessionDB
+
+	mu       sync.Mutex
+	prunedAt time.Time
+}
+
+type sessionValidator struct {
+	SessionDB
+}
+
+type sessionGorm struct {
+	db *gorm.DB
+}
+
+type sessionValFunc func(*RefreshToken) error
+
+func runSessionValFuncs(token *RefreshToken, fns ...sessionValFunc) error {
+	for _, fn := range fns {
+		if err := fn(token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func NewSessionService(db *gorm.DB) SessionService {
+	return &sessionService{
+		SessionDB: &sessionValidator{&sessionGorm{db}},
+	}
+}
+
+func (ss *sessionService) Start(userID uint, device, accessJTI string, accessExpiresAt time.Time) (*RefreshToken, error) {
+	family, err := rand.String(16)
+	if err != nil {
+		return nil, err
+	}
+	token := RefreshToken{
+		UserID:          userID,
+		Family:          family,
+		Device:          device,
+		AccessJTI:       accessJTI,
+		AccessExpiresAt: accessExpiresAt,
+	}
+	if err := ss.Create(&token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (ss *sessionService) Rotate(token, accessJTI string, accessExpiresAt time.Time) (*RefreshToken, error) {
+	current, err := ss.ByTokenHash(hashToken(token))
+	if err == ErrNotFound {
+		return nil, ErrTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if current.RevokedAt != nil {
+		return nil, ErrTokenInvalid
+	}
+	if current.UsedAt != nil {
+		if err := ss.RevokeFamily(current.Family); err != nil {
+			return nil, err
+		}
+		return nil, ErrTokenReused
+	}
+	if time.Now().After(current.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+
+	next := RefreshToken{
+		UserID:          current.UserID,
+		Family:          current.Family,
+		Device:          current.Device,
+		AccessJTI:       accessJTI,
+		AccessExpiresAt: accessExpiresAt,
+	}
+	switch err := ss.Exchange(current, &next); err {
+	case nil:
+	case ErrTokenReused:
+		// Another refresh got there first with the same token.
+		if err := ss.RevokeFamily(current.Family); err != nil {
+			return nil, err
+		}
+		return nil, err
+	default:
+		return nil, err
+	}
+	ss.prune()
+	return &next, nil
+}
+
+// prune clears out expired revocations, at most once every
+// revokedPruneEvery. The refresh it runs in has already
+// succeeded by then, so failing is only logged.
+func (ss *sessionService) prune() {
+	now := time.Now()
+	ss.mu.Lock()
+	if now.Sub(ss.prunedAt) < revokedPruneEvery {
+		ss.mu.Unlock()
+		return
+	}
+	ss.prunedAt = now
+	ss.mu.Unlock()
+	if err := ss.PruneRevoked(now); err != nil {
+		log.Println("session: prune:", err)
+	}
+}
+
+func (ss *sessionService) End(accessJTI string, accessExpiresAt time.Time) error {
+	if err := ss.RevokeJTI(accessJTI, accessExpiresAt); err != nil {
+		return err
+	}
+	token, err := ss.ByAccessJTI(accessJTI)
+	switch err {
+	case nil:
+		return ss.RevokeFamily(token.Family)
+	case ErrNotFound:
+		return nil
+	default:
+		return err
+	}
+}
+
+func (ss *sessionService) EndAll(userID uint) error {
+	active, err := ss.Active(userID)
+	if err != nil {
+		return err
+	}
+	for _, token := range active {
+		if err := ss.RevokeFamily(token.Family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Create generates the refresh token and its hash, and sets
+// when it expires.
+func (sv *sessionValidator) Create(token *RefreshToken) error {
+	err := runSessionValFuncs(token,
+		sv.userIDRequired,
+		sv.familyRequired,
+		sv.generateToken,
+		sv.hashToken,
+		sv.defaultExpiry)
+	if err != nil {
+		return err
+	}
+	return sv.SessionDB.Create(token)
+}
+
+// Exchange prepares next the same way Create does.
+func (sv *sessionValidator) Exchange(current, next *RefreshToken) error {
+	if current.ID <= 0 {
+		return ErrIDInvalid
+	}
+	err := runSessionValFuncs(next,
+		sv.userIDRequired,
+		sv.familyRequired,
+		sv.generateToken,
+		sv.hashToken,
+		sv.defaultExpiry)
+	if err != nil {
+		return err
+	}
+	return sv.SessionDB.Exchange(current, next)
+}
+
+func (sv *sessionValidator) RevokeJTI(jti string, expiresAt time.Time) error {
+	if jti == "" {
+		return ErrTokenInvalid
+	}
+	return sv.SessionDB.RevokeJTI(jti, expiresAt)
+}
+
+func (sv *sessionValidator) userIDRequired(t *RefreshToken) error {
+	if t.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (sv *sessionValidator) familyRequired(t *RefreshToken) error {
+	if t.Family == "" {
+		return ErrTokenInvalid
+	}
+	return nil
+}
+
+func (sv *sessionValidator) generateToken(t *RefreshToken) error {
+	if t.Token != "" {
+		return nil
+	}
+	token, err := rand.String(RefreshTokenBytes)
+	if err != nil {
+		return err
+	}
+	t.Token = token
+	return nil
+}
+
+func (sv *sessionValidator) hashToken(t *RefreshToken) error {
+	t.TokenHash = hashToken(t.Token)
+	return nil
+}
+
+func (sv *sessionValidator) defaultExpiry(t *RefreshToken) error {
+	if t.ExpiresAt.IsZero() {
+		t.ExpiresAt = time.Now().Add(RefreshTokenTTL)
+	}
+	return nil
+}
+
+// hashToken is what we store instead of a refresh token. The
+// tokens are long and random, so a plain SHA-256 is enough.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(sum[:])
+}
+
+func (sg *sessionGorm) ByTokenHash(hash string) (*RefreshToken, error) {
+	var token RefreshToken
+	db := sg.db.Where("token_hash = ?", hash)
+	err := first(db, &token)
+	return &token, err
+}
+
+func (sg *sessionGorm) ByAccessJTI(jti string) (*RefreshToken, error) {
+	var token RefreshToken
+	db := sg.db.Where("access_jti = ?", jti)
+	err := first(db, &token)
+	return &token, err
+}
+
+func (sg *sessionGorm) Active(userID uint) ([]RefreshToken, error) {
+	var tokens []RefreshToken
+	err := sg.db.
+		Where("user_id = ? AND used_at IS NULL AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Find(&tokens).Error
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (sg *sessionGorm) Create(token *RefreshToken) error {
+	return sg.db.Create(token).Error
+}
+
+func (sg *sessionGorm) Update(token *RefreshToken) error {
+	return sg.db.Save(token).Error
+}
+
+func (sg *sessionGorm) Exchange(current, next *RefreshToken) error {
+	return sg.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		res := tx.Model(&RefreshToken{}).
+			Where("id = ? AND used_at IS NULL AND revoked_at IS NULL", current.ID).
+			Update("used_at", now)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected != 1 {
+			return ErrTokenReused
+		}
+		current.UsedAt = &now
+		// The access token that came with the old refresh
+		// token is superseded by the one issued with next.
+		if current.AccessJTI != "" {
+			txg := &sessionGorm{tx}
+			if err := txg.RevokeJTI(current.AccessJTI, current.AccessExpiresAt); err != nil {
+				return err
+			}
+		}
+		return tx.Create(next).Error
+	})
+}
+
+func (sg *sessionGorm) RevokeFamily(family string) error {
+	var tokens []RefreshToken
+	err := sg.db.Where("family = ? AND revoked_at IS NULL", family).Find(&tokens).Error
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, token := range tokens {
+		if token.AccessJTI != "" && token.AccessExpiresAt.After(now) {
+			if err := sg.RevokeJTI(token.AccessJTI, token.AccessExpiresAt); err != nil {
+				return err
+			}
+		}
+	}
+	return sg.db.Model(&RefreshToken{}).
+		Where("family = ? AND revoked_at IS NULL", family).
+		Update("revoked_at", now).Error
+}
+
+func (sg *sessionGorm) RevokeJTI(jti string, expiresAt time.Time) error {
+	revoked, err := sg.IsRevoked(jti)
+	if err != nil || revoked {
+		return err
+	}
+	return sg.db.Create(&RevokedToken{JTI: jti, ExpiresAt: expiresAt}).Error
+}
+
+func (sg *sessionGorm) IsRevoked(jti string) (bool, error) {
+	var count int
+	err := sg.db.Model(&RevokedToken{}).Where("jti = ?", jti).Count(&count).Error
+	return count > 0, err
+}
+
+func (sg *sessionGorm) PruneRevoked(t time.Time) error {
+	return sg.db.Unscoped().Where("expires_at < ?", t).Delete(&RevokedToken{}).Error
+}
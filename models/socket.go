@@ -1 +1,439 @@
 package models
+
+import (
+	"context"
+	"encoding/json"
+	mrand "math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// socketWriteWait is the time allowed to write a single
+	// frame to a connection.
+	socketWriteWait = 10 * time.Second
+	// socketPongWait is the time allowed to read the next pong
+	// from a connection before it is considered dead.
+	socketPongWait = 60 * time.Second
+	// socketPingPeriod must be less than socketPongWait so a
+	// healthy connection always answers before the deadline.
+	socketPingPeriod = (socketPongWait * 9) / 10
+	// socketMaxMessageSize is the largest frame we will read
+	// from a client.
+	socketMaxMessageSize = 4096
+	// socketSendBuffer is how many outgoing frames may queue up
+	// for a single connection before it is dropped as too slow.
+	socketSendBuffer = 64
+	// socketReconnectMin and socketReconnectJitter bound, in
+	// milliseconds, how long clients are told to wait before
+	// reconnecting after a shutdown.
+	socketReconnectMin    = 1000
+	socketReconnectJitter = 4000
+)
+
+// SocketEvent is the envelope for every frame written to or
+// read from a socket connection.
+type SocketEvent struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// SocketHandler handles one frame a client sent. data is the
+// frame's raw "data" field.
+type SocketHandler func(userID uint, data json.RawMessage)
+
+// socketFrame is a SocketEvent as read off the wire, with Data
+// left for the handler to decode.
+type socketFrame struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// SocketService is a hub of WebSocket connections keyed by the
+// ID of the user that opened them. A user may have any number
+// of connections open at once (one per tab or device).
+type SocketService interface {
+	// Connect upgrades the request to a WebSocket connection
+	// and registers it under userID. The caller is expected to
+	// have authenticated the request already.
+	Connect(w http.ResponseWriter, r *http.Request, userID uint) error
+	// Send encodes payload as JSON and queues it on every
+	// connection owned by userID. Sending to a user with no
+	// open connections is not an error.
+	Send(userID uint, payload interface{}) error
+	// Broadcast queues payload on every open connection.
+	Broadcast(payload interface{}) error
+	// Handle registers h for frames of the given event type
+	// sent by clients. Frames that aren't JSON SocketEvents, or
+	// have a type nobody handles, are ignored. Handlers run on
+	// the connection's read loop, so they should be quick.
+	Handle(eventType string, h SocketHandler)
+	// OnConnect and OnDisconnect register fn to be called each
+	// time one of a user's connections opens or closes. A
+	// connection's OnConnect hooks finish before its
+	// OnDisconnect hooks start.
+	OnConnect(fn func(userID uint))
+	OnDisconnect(fn func(userID uint))
+	// Shutdown stops accepting connections and tells every
+	// client the server is restarting and when to reconnect.
+	// It flushes anything still queued, closes each connection
+	// with a 1012 (service restart) close frame and waits for
+	// them to finish, or for ctx to be done, whichever is first.
+	Shutdown(ctx context.Context) error
+	// Close is Shutdown without a deadline.
+	Close() error
+}
+
+// SocketRestart is the data of the "server.restart" event sent
+// to every client during Shutdown. Clients should wait
+// ReconnectInMS before reconnecting; the delay is spread out so
+// that they don't all come back at the same instant.
+type SocketRestart struct {
+	ReconnectInMS int `json:"reconnect_in_ms"`
+}
+
+type socketService struct {
+	upgrader websocket.Upgrader
+
+	mu      sync.RWMutex
+	clients map[uint]map[*socketClient]struct{}
+	closed  bool
+	wg      sync.WaitGroup
+	// connecting counts Connect calls that have registered a
+	// client but not yet run the connect hooks.
+	connecting sync.WaitGroup
+
+	hooksMu      sync.RWMutex
+	handlers     map[string]SocketHandler
+	onConnect    []func(userID uint)
+	onDisconnect []func(userID uint)
+}
+
+type socketClient struct {
+	ss     *socketService
+	userID uint
+	conn   *websocket.Conn
+	send   chan []byte
+
+	done      chan struct{}
+	closeOnce sync.Once
+	closeMsg  []byte
+}
+
+func NewSocketService() SocketService {
+	return &socketService{
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			// Connections are authenticated with a bearer token
+			// rather than cookies, so a cross-origin page cannot
+			// ride on a user's session.
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		clients:  make(map[uint]map[*socketClient]struct{}),
+		handlers: make(map[string]SocketHandler),
+	}
+}
+
+func (ss *socketService) Connect(w http.ResponseWriter, r *http.Request, userID uint) error {
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+	conn, err := ss.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied with an HTTP error.
+		return err
+	}
+	c := &socketClient{
+		ss:     ss,
+		userID: userID,
+		conn:   conn,
+		send:   make(chan []byte, socketSendBuffer),
+		done:   make(chan struct{}),
+	}
+	if err := ss.register(c); err != nil {
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server restarting, please reconnect"),
+			time.Now().Add(socketWriteWait))
+		conn.Close()
+		return err
+	}
+	// Run the hooks before the pumps start, and before
+	// Shutdown closes anything, so that they see a connection
+	// open before they see it close.
+	ss.hooksMu.RLock()
+	hooks := ss.onConnect
+	ss.hooksMu.RUnlock()
+	for _, fn := range hooks {
+		fn(userID)
+	}
+	ss.connecting.Done()
+	go c.writePump()
+	go c.readPump()
+	return nil
+}
+
+func (ss *socketService) Send(userID uint, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ss.mu.RLock()
+	if ss.closed {
+		ss.mu.RUnlock()
+		return ErrSocketClosed
+	}
+	slow := ss.enqueue(ss.clients[userID], data)
+	ss.mu.RUnlock()
+	ss.drop(slow)
+	return nil
+}
+
+func (ss *socketService) Broadcast(payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ss.mu.RLock()
+	if ss.closed {
+		ss.mu.RUnlock()
+		return ErrSocketClosed
+	}
+	var slow []*socketClient
+	for _, conns := range ss.clients {
+		slow = append(slow, ss.enqueue(conns, data)...)
+	}
+	ss.mu.RUnlock()
+	ss.drop(slow)
+	return nil
+}
+
+func (ss *socketService) Handle(eventType string, h SocketHandler) {
+	ss.hooksMu.Lock()
+	defer ss.hooksMu.Unlock()
+	ss.handlers[eventType] = h
+}
+
+func (ss *socketService) OnConnect(fn func(userID uint)) {
+	ss.hooksMu.Lock()
+	defer ss.hooksMu.Unlock()
+	ss.onConnect = append(ss.onConnect, fn)
+}
+
+func (ss *socketService) OnDisconnect(fn func(userID uint)) {
+	ss.hooksMu.Lock()
+	defer ss.hooksMu.Unlock()
+	ss.onDisconnect = append(ss.onDisconnect, fn)
+}
+
+// dispatch hands a frame read from c to its handler.
+func (ss *socketService) dispatch(c *socketClient, message []byte) {
+	var frame socketFrame
+	if err := json.Unmarshal(message, &frame); err != nil {
+		return
+	}
+	ss.hooksMu.RLock()
+	h, ok := ss.handlers[frame.Type]
+	ss.hooksMu.RUnlock()
+	if ok {
+		h(c.userID, frame.Data)
+	}
+}
+
+func (ss *socketService) Shutdown(ctx context.Context) error {
+	ss.mu.Lock()
+	if ss.closed {
+		ss.mu.Unlock()
+		return nil
+	}
+	ss.closed = true
+	ss.mu.Unlock()
+
+	// Nothing can register now, but connections that already
+	// did may still be running their connect hooks.
+	ss.connecting.Wait()
+
+	ss.mu.RLock()
+	var all []*socketClient
+	for _, conns := range ss.clients {
+		for c := range conns {
+			all = append(all, c)
+		}
+	}
+	ss.mu.RUnlock()
+
+	for _, c := range all {
+		restart := SocketEvent{
+			Type: "server.restart",
+			Data: SocketRestart{ReconnectInMS: socketReconnectMin + mrand.Intn(socketReconnectJitter)},
+		}
+		if data, err := json.Marshal(restart); err == nil {
+			select {
+			case c.send <- data:
+			default:
+			}
+		}
+		c.close(websocket.CloseServiceRestart, "server restarting, please reconnect")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ss.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		// Out of time; cut off whoever is still flushing.
+		for _, c := range all {
+			c.conn.Close()
+		}
+		return ctx.Err()
+	}
+}
+
+func (ss *socketService) Close() error {
+	return ss.Shutdown(context.Background())
+}
+
+// enqueue queues data on every connection in conns without
+// blocking and returns the connections whose buffers were full.
+// The caller must hold at least a read lock.
+func (ss *socketService) enqueue(conns map[*socketClient]struct{}, data []byte) []*socketClient {
+	var slow []*socketClient
+	for c := range conns {
+		select {
+		case c.send <- data:
+		default:
+			slow = append(slow, c)
+		}
+	}
+	return slow
+}
+
+// drop closes connections that could not keep up. It must be
+// called without holding the lock since closing unregisters.
+func (ss *socketService) drop(slow []*socketClient) {
+	for _, c := range slow {
+		c.close(websocket.ClosePolicyViolation, "client too slow")
+	}
+}
+
+func (ss *socketService) register(c *socketClient) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.closed {
+		return ErrSocketClosed
+	}
+	conns, ok := ss.clients[c.userID]
+	if !ok {
+		conns = make(map[*socketClient]struct{})
+		ss.clients[c.userID] = conns
+	}
+	conns[c] = struct{}{}
+	ss.wg.Add(2)
+	ss.connecting.Add(1)
+	return nil
+}
+
+func (ss *socketService) unregister(c *socketClient) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	conns, ok := ss.clients[c.userID]
+	if !ok {
+		return
+	}
+	delete(conns, c)
+	if len(conns) == 0 {
+		delete(ss.clients, c.userID)
+	}
+}
+
+// close asks the write pump to flush what is queued, send a
+// close frame with the given code and shut the connection.
+// It is safe to call more than once.
+func (c *socketClient) close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeMsg = websocket.FormatCloseMessage(code, reason)
+		c.ss.unregister(c)
+		close(c.done)
+		// Hooks may send, which may drop and close other
+		// clients, so no lock is held while they run.
+		c.ss.hooksMu.RLock()
+		hooks := c.ss.onDisconnect
+		c.ss.hooksMu.RUnlock()
+		for _, fn := range hooks {
+			fn(c.userID)
+		}
+	})
+}
+
+func (c *socketClient) readPump() {
+	defer c.ss.wg.Done()
+	defer c.close(websocket.CloseNormalClosure, "")
+
+	c.conn.SetReadLimit(socketMaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	})
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.conn.SetReadDeadline(time.Now().Add(socketPongWait))
+		c.ss.dispatch(c, message)
+	}
+}
+
+func (c *socketClient) writePump() {
+	ticker := time.NewTicker(socketPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+		c.ss.wg.Done()
+	}()
+
+	for {
+		select {
+		case data := <-c.send:
+			if err := c.write(websocket.TextMessage, data); err != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-ticker.C:
+			if err := c.write(websocket.PingMessage, nil); err != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-c.done:
+			c.flush()
+			c.write(websocket.CloseMessage, c.closeMsg)
+			return
+		}
+	}
+}
+
+// flush writes whatever is still queued on the connection.
+func (c *socketClient) flush() {
+	for {
+		select {
+		case data := <-c.send:
+			if err := c.write(websocket.TextMessage, data); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (c *socketClient) write(messageType int, data []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+	return c.conn.WriteMessage(messageType, data)
+}
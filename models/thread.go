@@ -0,0 +1,103 @@
+package models
+
+type ThreadDB interface {
+	// Parent is ByID, except deleted messages are returned too
+	// so that a thread outlives the message that started it.
+	Parent(id uint) (*Message, error)
+	// Replies is Conversation for the replies to parentID.
+	Replies(parentID, before uint, limit int) ([]Message, error)
+	// ReplyCounts returns how many replies each of messageIDs
+	// has, not counting deleted ones. Messages without replies
+	// are left out.
+	ReplyCounts(messageIDs []uint) (map[uint]int, error)
+}
+
+func (ms *messageService) Thread(id, userID, before uint, limit int) (*Message, []Message, error) {
+	parent, err := ms.Parent(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ms.canSee(parent, userID); err != nil {
+		return nil, nil, err
+	}
+	replies, err := ms.Replies(parent.ID, before, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	return parent, replies, nil
+}
+
+func (mv *messageValidator) Parent(id uint) (*Message, error) {
+	if id <= 0 {
+		return nil, ErrIDInvalid
+	}
+	return mv.MessageDB.Parent(id)
+}
+
+func (mv *messageValidator) Replies(parentID, before uint, limit int) ([]Message, error) {
+	if parentID <= 0 {
+		return nil, ErrIDInvalid
+	}
+	return mv.MessageDB.Replies(parentID, before, messagePageSize(limit))
+}
+
+// quoteParent makes sure a reply's parent is a live message in
+// the same conversation and copies it into the quote.
+func (mv *messageValidator) quoteParent(m *Message) error {
+	if m.ParentID <= 0 {
+		return nil
+	}
+	parent, err := mv.ByID(m.ParentID)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		return ErrParentNotFound
+	default:
+		return err
+	}
+	same := parent.ConversationID == m.ConversationID
+	if m.ConversationID == 0 {
+		same = parent.ConversationID == 0 && parent.Between(m.SenderID, m.RecipientID)
+	}
+	if !same {
+		return ErrParentNotFound
+	}
+	m.QuoteSenderID = parent.SenderID
+	m.QuoteBody = parent.Body
+	return nil
+}
+
+func (mg *messageGorm) Parent(id uint) (*Message, error) {
+	var message Message
+	err := first(mg.db.Unscoped().Where("id = ?", id), &message)
+	return &message, err
+}
+
+func (mg *messageGorm) Replies(parentID, before uint, limit int) ([]Message, error) {
+	return mg.page(mg.db.Where("parent_id = ?", parentID), before, limit)
+}
+
+func (mg *messageGorm) ReplyCounts(messageIDs []uint) (map[uint]int, error) {
+	counts := make(map[uint]int)
+	if len(messageIDs) == 0 {
+		return counts, nil
+	}
+	rows, err := mg.db.Table("messages").
+		Select("parent_id, COUNT(*)").
+		Where("parent_id IN (?) AND deleted_at IS NULL", messageIDs).
+		Group("parent_id").
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var parentID uint
+		var count int
+		if err := rows.Scan(&parentID, &count); err != nil {
+			return nil, err
+		}
+		counts[parentID] = count
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,173 @@
+package models
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// typingExpireAfter is how long a typing indicator lasts
+	// without another "typing.start" from the client. Clients
+	// that crash or lose their connection mid-sentence stop
+	// showing as typing after this long.
+	typingExpireAfter = 6 * time.Second
+	// typingRelayEvery is the most often a repeated
+	// "typing.start" is passed on to the partner. Starts in
+	// between only push the expiry back. It is also how often
+	// the typist is checked against the friends graph.
+	typingRelayEvery = 3 * time.Second
+	// typingFrameEvery is the most often a "typing.start" for
+	// the same partner is looked at. Faster ones are dropped
+	// without any other work.
+	typingFrameEvery = 500 * time.Millisecond
+)
+
+// TypingEvent is the data of the "typing.start" and
+// "typing.stop" events clients send, and of the
+// "typing.started" and "typing.stopped" events relayed to
+// their partner. UserID is the partner when sent by a client
+// and the typist when relayed.
+type TypingEvent struct {
+	UserID uint `json:"user_id"`
+}
+
+// TypingService relays typing indicators between friends over
+// the socket hub. Nothing about them is stored.
+type TypingService interface {
+	// Stop ends userID's typing indicator in the conversation
+	// with partnerID, if it is showing. Sending a message does
+	// this.
+	Stop(userID, partnerID uint)
+	// Close clears every indicator without telling anyone.
+	Close() error
+}
+
+type typingService struct {
+	sockets SocketService
+	friends FriendDB
+
+	mu     sync.Mutex
+	typing map[[2]uint]*typingState
+}
+
+// typingState is one user typing to one partner. It is kept
+// even when they may not talk, so that repeated starts are
+// throttled the same way; shown is false for those.
+type typingState struct {
+	seenAt    time.Time
+	relayedAt time.Time
+	shown     bool
+	expire    *time.Timer
+}
+
+// NewTypingService registers the typing handlers on sockets.
+// friends is used to make sure indicators only reach people
+// the typist may message.
+func NewTypingService(sockets SocketService, friends FriendDB) TypingService {
+	ts := &typingService{
+		sockets: sockets,
+		friends: friends,
+		typing:  make(map[[2]uint]*typingState),
+	}
+	sockets.Handle("typing.start", ts.start)
+	sockets.Handle("typing.stop", ts.stop)
+	return ts
+}
+
+func (ts *typingService) Stop(userID, partnerID uint) {
+	if ts.clear(userID, partnerID) {
+		ts.relay("typing.stopped", userID, partnerID)
+	}
+}
+
+func (ts *typingService) Close() error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for key, st := range ts.typing {
+		st.expire.Stop()
+		delete(ts.typing, key)
+	}
+	return nil
+}
+
+func (ts *typingService) start(userID uint, data json.RawMessage) {
+	var ev TypingEvent
+	if err := json.Unmarshal(data, &ev); err != nil || ev.UserID == 0 {
+		return
+	}
+	partnerID := ev.UserID
+	key := [2]uint{userID, partnerID}
+	now := time.Now()
+
+	ts.mu.Lock()
+	st, ok := ts.typing[key]
+	if ok && now.Sub(st.seenAt) < typingFrameEvery {
+		ts.mu.Unlock()
+		return
+	}
+	if ok {
+		st.expire.Reset(typingExpireAfter)
+	} else {
+		st = &typingState{
+			expire: time.AfterFunc(typingExpireAfter, func() { ts.Stop(userID, partnerID) }),
+		}
+		ts.typing[key] = st
+	}
+	st.seenAt = now
+	relay := now.Sub(st.relayedAt) >= typingRelayEvery
+	if relay {
+		st.relayedAt = now
+	}
+	ts.mu.Unlock()
+	if !relay {
+		return
+	}
+
+	// Only starts that would be relayed hit the database, which
+	// includes the first one of every indicator.
+	allowed := canTalk(ts.friends, userID, partnerID) == nil
+	ts.mu.Lock()
+	if ts.typing[key] != st {
+		// Stopped while we were checking.
+		ts.mu.Unlock()
+		return
+	}
+	st.shown = allowed
+	ts.mu.Unlock()
+
+	if allowed {
+		ts.relay("typing.started", userID, partnerID)
+	}
+}
+
+func (ts *typingService) stop(userID uint, data json.RawMessage) {
+	var ev TypingEvent
+	if err := json.Unmarshal(data, &ev); err != nil || ev.UserID == 0 {
+		return
+	}
+	ts.Stop(userID, ev.UserID)
+}
+
+// clear forgets the indicator and reports whether the partner
+// was shown it.
+func (ts *typingService) clear(userID, partnerID uint) bool {
+	key := [2]uint{userID, partnerID}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	st, ok := ts.typing[key]
+	if !ok {
+		return false
+	}
+	st.expire.Stop()
+	delete(ts.typing, key)
+	return st.shown
+}
+
+func (ts *typingService) relay(eventType string, userID, partnerID uint) {
+	event := SocketEvent{Type: eventType, Data: TypingEvent{UserID: userID}}
+	if err := ts.sockets.Send(partnerID, event); err != nil && err != ErrSocketClosed {
+		log.Println("typing: send:", err)
+	}
+}
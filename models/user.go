@@ -1,32 +1,71 @@
 package models
 
 import (
+	"fmt"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	handleMinLength = 3
+	handleMaxLength = 20
+	// DefaultSearchLimit is how many users a search returns
+	// when the caller does not ask for a size.
+	DefaultSearchLimit = 20
+	// MaxSearchLimit caps the size of a search page.
+	MaxSearchLimit = 50
+)
+
+// reservedHandles can't be claimed by anyone since they could
+// be mistaken for the app itself or clash with routes.
+var reservedHandles = map[string]bool{
+	"admin": true, "administrator": true, "api": true,
+	"everyone": true, "help": true, "login": true,
+	"logout": true, "me": true, "moderator": true,
+	"null": true, "root": true, "settings": true,
+	"signup": true, "sockets": true, "support": true,
+	"system": true, "undefined": true,
+}
+
 type User struct {
 	gorm.Model
 	Name         string
 	Email        string `gorm:"not null; unique_index"`
+	Handle       string `gorm:"unique_index"`
 	Password     string `gorm:"-"`
 	PasswordHash string `gorm:"not null"`
+	// LastSeenAt is when the user's last socket connection
+	// closed. It is nil for users who never connected.
+	LastSeenAt *time.Time
 }
 
 type UserService interface {
 	Authenticate(email, password string) (*User, error)
-	JwtSecret() string
 	UserDB
 }
 
 type UserDB interface {
 	ByID(id uint) (*User, error)
+	// ByIDs returns the users with the given IDs, in no
+	// particular order. IDs that match nobody are skipped.
+	ByIDs(ids []uint) ([]User, error)
 	ByEmail(email string) (*User, error)
+	// ByHandle looks up a user by handle, ignoring case and a
+	// leading @.
+	ByHandle(handle string) (*User, error)
+	// Search returns up to limit users whose handle or name
+	// starts with query, ignoring case and skipping any user
+	// whose ID is in exclude.
+	Search(query string, exclude []uint, limit int) ([]User, error)
 	Create(user *User) error
 	Update(user *User) error
+	// SetLastSeen records when user id was last online without
+	// touching, or validating, the rest of the row.
+	SetLastSeen(id uint, at time.Time) error
 	Delete(id uint) error
 }
 
@@ -36,31 +75,28 @@ type userDbHandle struct {
 
 type userValidator struct {
 	UserDB
-	emailRegex *regexp.Regexp
-	pepper     string
-	jwtSecret  string
+	emailRegex  *regexp.Regexp
+	handleRegex *regexp.Regexp
+	pepper      string
 }
 
 type userService struct {
 	UserDB
-	pepper    string
-	jwtSecret string
+	pepper string
 }
 
 type userValFunc func(*User) error
 
-func NewUserService(db *gorm.DB, pepper, jwtSecret string) UserService {
-	ud := &userDbHandle{db}
-	uv := newUserValidationLayer(ud, pepper, jwtSecret)
-	return &userService{
-		UserDB:    uv,
-		pepper:    pepper,
-		jwtSecret: jwtSecret,
-	}
+func NewUserService(db *gorm.DB, pepper string) UserService {
+	return newUserService(&userDbHandle{db}, pepper)
 }
 
-func (us *userService) JwtSecret() string {
-	return us.jwtSecret
+func newUserService(ud UserDB, pepper string) UserService {
+	uv := newUserValidationLayer(ud, pepper)
+	return &userService{
+		UserDB: uv,
+		pepper: pepper,
+	}
 }
 
 func (us *userService) Authenticate(email, password string) (*User, error) {
@@ -94,6 +130,34 @@ func (uv *userValidator) ByEmail(email string) (*User, error) {
 	return uv.UserDB.ByEmail(user.Email)
 }
 
+// ByHandle will normalize the handle before calling ByHandle
+// on the UserDB field.
+func (uv *userValidator) ByHandle(handle string) (*User, error) {
+	user := User{
+		Handle: handle,
+	}
+	if err := runUserValFuncs(&user, uv.normalizeHandle); err != nil {
+		return nil, err
+	}
+	return uv.UserDB.ByHandle(user.Handle)
+}
+
+// Search trims the query and clamps limit before searching.
+// An empty query matches nobody rather than everybody.
+func (uv *userValidator) Search(query string, exclude []uint, limit int) ([]User, error) {
+	query = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(query), "@"))
+	if query == "" {
+		return []User{}, nil
+	}
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	}
+	if limit > MaxSearchLimit {
+		limit = MaxSearchLimit
+	}
+	return uv.UserDB.Search(query, exclude, limit)
+}
+
 // Create will create the provided user and backfill data
 // like the ID, CreatedAt, and UpdatedAt fields.
 func (uv *userValidator) Create(user *User) error {
@@ -105,7 +169,12 @@ func (uv *userValidator) Create(user *User) error {
 		uv.normalizeEmail,
 		uv.requireEmail,
 		uv.emailFormat,
-		uv.emailIsAvail)
+		uv.emailIsAvail,
+		uv.normalizeHandle,
+		uv.defaultHandle,
+		uv.handleFormat,
+		uv.handleNotReserved,
+		uv.handleIsAvail)
 	if err != nil {
 		return err
 	}
@@ -121,7 +190,12 @@ func (uv *userValidator) Update(user *User) error {
 		uv.normalizeEmail,
 		uv.requireEmail,
 		uv.emailFormat,
-		uv.emailIsAvail)
+		uv.emailIsAvail,
+		uv.normalizeHandle,
+		uv.defaultHandle,
+		uv.handleFormat,
+		uv.handleNotReserved,
+		uv.handleIsAvail)
 	if err != nil {
 		return err
 	}
@@ -206,6 +280,82 @@ func (uv *userValidator) emailIsAvail(user *User) error {
 	return nil
 }
 
+// normalizeHandle lower cases the handle and strips the @
+// people tend to type in front of it, so handles are unique
+// regardless of case.
+func (uv *userValidator) normalizeHandle(user *User) error {
+	user.Handle = strings.TrimSpace(user.Handle)
+	user.Handle = strings.TrimPrefix(user.Handle, "@")
+	user.Handle = strings.ToLower(user.Handle)
+	return nil
+}
+
+// defaultHandle gives users who didn't pick a handle one based
+// on their email address, adding a number until it is free.
+// It must run after the email has been normalized.
+func (uv *userValidator) defaultHandle(user *User) error {
+	if user.Handle != "" {
+		return nil
+	}
+	local := user.Email
+	if i := strings.Index(local, "@"); i >= 0 {
+		local = local[:i]
+	}
+	base := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return -1
+	}, local)
+	// Leave room for a numeric suffix.
+	if len(base) > handleMaxLength-4 {
+		base = base[:handleMaxLength-4]
+	}
+	for len(base) < handleMinLength || reservedHandles[base] {
+		base += "_"
+	}
+	handle := base
+	for i := 1; ; i++ {
+		existing, err := uv.UserDB.ByHandle(handle)
+		if err == ErrNotFound || (err == nil && existing.ID == user.ID) {
+			user.Handle = handle
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		handle = fmt.Sprintf("%s%d", base, i)
+	}
+}
+
+func (uv *userValidator) handleFormat(user *User) error {
+	if !uv.handleRegex.MatchString(user.Handle) {
+		return ErrHandleInvalid
+	}
+	return nil
+}
+
+func (uv *userValidator) handleNotReserved(user *User) error {
+	if reservedHandles[user.Handle] {
+		return ErrHandleReserved
+	}
+	return nil
+}
+
+func (uv *userValidator) handleIsAvail(user *User) error {
+	existing, err := uv.UserDB.ByHandle(user.Handle)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.ID != existing.ID {
+		return ErrHandleTaken
+	}
+	return nil
+}
+
 func (uv *userValidator) passwordMinLength(user *User) error {
 	if user.Password == "" {
 		return nil
@@ -230,13 +380,14 @@ func (uv *userValidator) passwordHashRequired(user *User) error {
 	return nil
 }
 
-func newUserValidationLayer(udb UserDB, pepper, jwtSecret string) *userValidator {
+func newUserValidationLayer(udb UserDB, pepper string) *userValidator {
 	return &userValidator{
-		UserDB:    udb,
-		jwtSecret: jwtSecret,
-		pepper:    pepper,
+		UserDB: udb,
+		pepper: pepper,
 		emailRegex: regexp.MustCompile(
 			`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
+		handleRegex: regexp.MustCompile(
+			fmt.Sprintf(`^[a-z0-9_]{%d,%d}$`, handleMinLength, handleMaxLength)),
 	}
 }
 
@@ -265,6 +416,17 @@ func (ug *userDbHandle) ByID(id uint) (*User, error) {
 	return &user, err
 }
 
+func (ug *userDbHandle) ByIDs(ids []uint) ([]User, error) {
+	users := []User{}
+	if len(ids) == 0 {
+		return users, nil
+	}
+	if err := ug.db.Where("id IN (?)", ids).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
 // ByEmail looks up a user with the given email address and
 // returns that user.
 // If the user is found, we will return a nil error
@@ -282,22 +444,74 @@ func (ug *userDbHandle) ByEmail(email string) (*User, error) {
 	return &user, err
 }
 
+// ByHandle looks up a user with the given handle. Handles
+// are stored lower case so this expects a normalized handle.
+// If the user is not found, we will return ErrNotFound
+func (ug *userDbHandle) ByHandle(handle string) (*User, error) {
+	var user User
+	db := ug.db.Where("handle = ?", handle)
+	err := first(db, &user)
+	return &user, err
+}
+
+// Search does a case-insensitive prefix match on handle and
+// name. The query is expected to be lower case already.
+func (ug *userDbHandle) Search(query string, exclude []uint, limit int) ([]User, error) {
+	var users []User
+	prefix := likeEscaper.Replace(query) + "%"
+	db := ug.db.Where(`handle LIKE ? ESCAPE '\' OR LOWER(name) LIKE ? ESCAPE '\'`, prefix, prefix)
+	if len(exclude) > 0 {
+		db = db.Where("id NOT IN (?)", exclude)
+	}
+	err := db.Order("handle").Limit(limit).Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// likeEscaper escapes the LIKE wildcards so that user input
+// is matched literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
 // Create will create the provided user and backfill data
 // like the ID, CreatedAt, and UpdatedAt fields.
 func (ug *userDbHandle) Create(user *User) error {
-	return ug.db.Create(user).Error
+	return userConstraintError(ug.db.Create(user).Error)
 }
 
 // Update will update the provided user with all of the data
 // in the provided user object.
 func (ug *userDbHandle) Update(user *User) error {
-	return ug.db.Save(user).Error
+	return userConstraintError(ug.db.Save(user).Error)
 }
 
-// Delete will delete the user with the provided ID
+// userConstraintError turns a clash on the unique email or
+// handle index into ErrDuplicate. The validator checks both
+// first, so this only happens when two writes race.
+func userConstraintError(err error) error {
+	if violated(err) == constraintUnique {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (ug *userDbHandle) SetLastSeen(id uint, at time.Time) error {
+	return ug.db.Model(&User{}).Where("id = ?", id).UpdateColumn("last_seen_at", at).Error
+}
+
+// Delete will delete the user with the provided ID, along
+// with every friend row on either side of them. Users are only
+// soft deleted, so the foreign keys' ON DELETE CASCADE never
+// gets the chance to do this for us.
 func (ug *userDbHandle) Delete(id uint) error {
 	user := User{Model: gorm.Model{ID: id}}
-	return ug.db.Delete(&user).Error
+	return ug.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&user).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ? OR friend_id = ?", id, id).Delete(&Friend{}).Error
+	})
 }
 
 // first will query using the provided gorm.DB and it will
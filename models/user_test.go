@@ -0,0 +1,58 @@
+package models
+
+import "testing"
+
+func TestFirstNotFound(t *testing.T) {
+	s := newSQLiteServices(t)
+	var user User
+	err := first(s.db.Where("email = ?", "nobody@example.com"), &user)
+	if err != ErrNotFound {
+		t.Fatalf("first() = %v, want ErrNotFound", err)
+	}
+}
+
+func TestUserDeletedNotFound(t *testing.T) {
+	s := newSQLiteServices(t)
+	ug := &userDbHandle{s.db}
+	user := mustCreateUser(t, ug, "ann@example.com", "ann")
+	if err := ug.Delete(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ug.ByID(user.ID); err != ErrNotFound {
+		t.Errorf("ByID of deleted user = %v, want ErrNotFound", err)
+	}
+	if _, err := ug.ByEmail("ann@example.com"); err != ErrNotFound {
+		t.Errorf("ByEmail of deleted user = %v, want ErrNotFound", err)
+	}
+}
+
+func TestUserUniqueEmail(t *testing.T) {
+	s := newSQLiteServices(t)
+	ug := &userDbHandle{s.db}
+	first := mustCreateUser(t, ug, "ann@example.com", "ann")
+
+	dup := User{Email: "ann@example.com", Handle: "ann2", PasswordHash: "hash"}
+	if err := ug.Create(&dup); err != ErrDuplicate {
+		t.Fatalf("Create with taken email = %v, want ErrDuplicate", err)
+	}
+	// The index covers soft deleted users as well.
+	if err := ug.Delete(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	dup = User{Email: "ann@example.com", Handle: "ann3", PasswordHash: "hash"}
+	if err := ug.Create(&dup); err != ErrDuplicate {
+		t.Fatalf("Create with deleted user's email = %v, want ErrDuplicate", err)
+	}
+}
+
+func TestUserServiceEmailTaken(t *testing.T) {
+	s := newSQLiteServices(t)
+	user := User{Email: "ann@example.com", Password: "password123"}
+	if err := s.User.Create(&user); err != nil {
+		t.Fatal(err)
+	}
+	dup := User{Email: " Ann@Example.com ", Password: "password123"}
+	if err := s.User.Create(&dup); err != ErrEmailTaken {
+		t.Fatalf("Create with taken email = %v, want ErrEmailTaken", err)
+	}
+}
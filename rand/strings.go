@@ -0,0 +1,41 @@
+package rand
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// Bytes will help us generate n random bytes, or will
+// return an error if there was one. This uses the
+// crypto/rand package so it is safe to use with things
+// like tokens.
+func Bytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// String will generate a byte slice of size nBytes and then
+// return a string that is the base64 URL encoded version
+// of that byte slice
+func String(nBytes int) (string, error) {
+	b, err := Bytes(nBytes)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+// Hex works like String but hex encodes the bytes, which is
+// handier for short identifiers that end up in logs.
+func Hex(nBytes int) (string, error) {
+	b, err := Bytes(nBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
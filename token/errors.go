@@ -0,0 +1,24 @@
+package token
+
+const (
+	// ErrMalformed is returned when a token can't be decoded.
+	ErrMalformed tokenError = "token: malformed token"
+	// ErrExpired is returned when a token is past its expiry.
+	ErrExpired tokenError = "token: token has expired"
+	// ErrInvalid is returned for every other reason a token is
+	// rejected, such as an unknown key, a bad signature or the
+	// wrong issuer or audience.
+	ErrInvalid tokenError = "token: token is not valid"
+	// ErrNoKeys is returned when an Issuer is built without any
+	// keys or with an active key it doesn't have.
+	ErrNoKeys tokenError = "token: no signing key configured"
+	// ErrKeyType is returned when a key file doesn't hold the
+	// kind of key its algorithm needs.
+	ErrKeyType tokenError = "token: key does not match algorithm"
+)
+
+type tokenError string
+
+func (e tokenError) Error() string {
+	return string(e)
+}
@@ -0,0 +1,180 @@
+// Package token issues and verifies the JWT access tokens used
+// to authenticate API requests.
+package token
+
+import (
+	"fmt"
+	"sockets/rand"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Claims are the claims we put in every access token. The user
+// ID is carried in the standard sub claim.
+type Claims struct {
+	jwt.StandardClaims
+}
+
+// UserID parses the subject claim.
+func (c *Claims) UserID() (uint, error) {
+	id, err := strconv.ParseUint(c.Subject, 10, 32)
+	if err != nil || id == 0 {
+		return 0, ErrInvalid
+	}
+	return uint(id), nil
+}
+
+// SetUserID sets the subject claim.
+func (c *Claims) SetUserID(id uint) {
+	c.Subject = strconv.FormatUint(uint64(id), 10)
+}
+
+// ExpiresAtTime is ExpiresAt as a time.Time.
+func (c *Claims) ExpiresAtTime() time.Time {
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+// Issuer signs tokens with its active key and verifies tokens
+// signed by any of its keys, picking the key by the kid header.
+// Rotating keys is a matter of adding a new key, making it the
+// active one and dropping the old key once every token it
+// signed has expired.
+type Issuer struct {
+	issuer   string
+	audience string
+	active   *Key
+	keys     map[string]*Key
+}
+
+// NewIssuer returns an Issuer that signs with the key whose ID
+// is activeID. issuer and audience are written to and required
+// in every token.
+func NewIssuer(issuer, audience, activeID string, keys ...*Key) (*Issuer, error) {
+	i := &Issuer{
+		issuer:   issuer,
+		audience: audience,
+		keys:     make(map[string]*Key, len(keys)),
+	}
+	for _, k := range keys {
+		if _, dup := i.keys[k.ID]; dup {
+			return nil, fmt.Errorf("token: duplicate key id %q", k.ID)
+		}
+		i.keys[k.ID] = k
+	}
+	active, ok := i.keys[activeID]
+	if !ok || !active.CanSign() {
+		return nil, ErrNoKeys
+	}
+	i.active = active
+	return i, nil
+}
+
+// Issue signs a new token for userID that expires after ttl.
+func (i *Issuer) Issue(userID uint, ttl time.Duration) (string, *Claims, error) {
+	claims, err := i.NewClaims(ttl)
+	if err != nil {
+		return "", nil, err
+	}
+	claims.SetUserID(userID)
+	signed, err := i.Sign(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	return signed, claims, nil
+}
+
+// NewClaims fills in everything but the subject for a token
+// that expires after ttl. Every token gets a random jti so it
+// can be revoked on its own. This is for callers that need the
+// jti before they know who the token is for; everyone else
+// should use Issue.
+func (i *Issuer) NewClaims(ttl time.Duration) (*Claims, error) {
+	jti, err := rand.String(16)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &Claims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    i.issuer,
+			Audience:  i.audience,
+			Id:        jti,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(ttl).Unix(),
+		},
+	}, nil
+}
+
+// Sign signs claims with the active key.
+func (i *Issuer) Sign(claims *Claims) (string, error) {
+	t := jwt.NewWithClaims(i.active.Method, claims)
+	t.Header["kid"] = i.active.ID
+	return t.SignedString(i.active.sign)
+}
+
+// Verify checks the signature, expiry, issuer and audience of
+// tokenString and returns its claims. The error is always one
+// of ErrMalformed, ErrExpired or ErrInvalid.
+func (i *Issuer) Verify(tokenString string) (*Claims, error) {
+	var claims Claims
+	t, err := jwt.ParseWithClaims(tokenString, &claims, i.keyFunc)
+	if err != nil {
+		if ve, ok := err.(*jwt.ValidationError); ok {
+			switch {
+			case ve.Errors&jwt.ValidationErrorMalformed != 0:
+				return nil, ErrMalformed
+			case ve.Errors&jwt.ValidationErrorExpired != 0:
+				return nil, ErrExpired
+			}
+		}
+		return nil, ErrInvalid
+	}
+	if !t.Valid ||
+		!claims.VerifyIssuer(i.issuer, true) ||
+		!claims.VerifyAudience(i.audience, true) ||
+		claims.Id == "" {
+		return nil, ErrInvalid
+	}
+	if _, err := claims.UserID(); err != nil {
+		return nil, ErrInvalid
+	}
+	return &claims, nil
+}
+
+// keyFunc finds the key named by the kid header. The algorithm
+// must be the one that key was made for; trusting the alg
+// header alone would let an attacker pick a weaker one.
+func (i *Issuer) keyFunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	key, ok := i.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("token: unknown key id %q", kid)
+	}
+	if t.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("token: unexpected signing algorithm %q", t.Method.Alg())
+	}
+	return key.verify, nil
+}
+
+// JWKS is a JSON Web Key Set (RFC 7517).
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys other services need to verify
+// our tokens. HMAC keys are secret and never included.
+func (i *Issuer) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+	for _, k := range i.keys {
+		if jwk, ok := k.JWK(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	sort.Slice(set.Keys, func(a, b int) bool {
+		return set.Keys[a].KeyID < set.Keys[b].KeyID
+	})
+	return set
+}
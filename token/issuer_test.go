@@ -0,0 +1,199 @@
+package token
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	testIssuer   = "sockets"
+	testAudience = "sockets-api"
+)
+
+// newEdDSAKey returns a fresh Ed25519 key along with the PEM
+// of its public half.
+func newEdDSAKey(t *testing.T, id string) (*Key, []byte) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := NewEdDSAKey(id, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+}
+
+func newRSAKey(t *testing.T, id string) *Key {
+	t.Helper()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der := x509.MarshalPKCS1PrivateKey(priv)
+	key, err := NewRSAKey(id, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newIssuer(t *testing.T, audience, activeID string, keys ...*Key) *Issuer {
+	t.Helper()
+	i, err := NewIssuer(testIssuer, audience, activeID, keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return i
+}
+
+// sign builds a token by hand so tests can set headers and
+// claims the Issuer would never write.
+func sign(t *testing.T, method jwt.SigningMethod, kid interface{}, key interface{}, claims *Claims) string {
+	t.Helper()
+	tok := jwt.NewWithClaims(method, claims)
+	if kid != nil {
+		tok.Header["kid"] = kid
+	}
+	signed, err := tok.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestVerify(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	hmac := NewHMACKey("hmac", secret)
+	ed, _ := newEdDSAKey(t, "ed")
+	issuer := newIssuer(t, testAudience, "ed", ed, hmac)
+
+	claims := func(ttl time.Duration) *Claims {
+		c, err := issuer.NewClaims(ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetUserID(7)
+		return c
+	}
+	edPub := []byte(ed.verify.(ed25519.PublicKey))
+	stranger, _ := newEdDSAKey(t, "ed")
+	otherAudience := newIssuer(t, "someone-else", "ed", ed)
+	otherSigned, _, err := otherAudience.Issue(7, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, _, err := issuer.Issue(7, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"valid", good, nil},
+		{"valid hmac", sign(t, jwt.SigningMethodHS256, "hmac", secret, claims(time.Minute)), nil},
+		{"malformed", "not.a.token", ErrMalformed},
+		{"missing kid", sign(t, SigningMethodEdDSA, nil, ed.sign, claims(time.Minute)), ErrInvalid},
+		{"unknown kid", sign(t, SigningMethodEdDSA, "nope", ed.sign, claims(time.Minute)), ErrInvalid},
+		{"kid not a string", sign(t, SigningMethodEdDSA, 1, ed.sign, claims(time.Minute)), ErrInvalid},
+		{"wrong signer", sign(t, SigningMethodEdDSA, "ed", stranger.sign, claims(time.Minute)), ErrInvalid},
+		// The public key is no secret, so an HS256 token keyed
+		// with it must not pass for the EdDSA key.
+		{"hs256 with eddsa kid", sign(t, jwt.SigningMethodHS256, "ed", edPub, claims(time.Minute)), ErrInvalid},
+		{"eddsa with hmac kid", sign(t, SigningMethodEdDSA, "hmac", ed.sign, claims(time.Minute)), ErrInvalid},
+		{"wrong audience", otherSigned, ErrInvalid},
+		{"expired", sign(t, SigningMethodEdDSA, "ed", ed.sign, claims(-time.Minute)), ErrExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := issuer.Verify(tt.token)
+			if err != tt.want {
+				t.Fatalf("Verify() err = %v, want %v", err, tt.want)
+			}
+			if err == nil {
+				if id, _ := got.UserID(); id != 7 {
+					t.Errorf("UserID() = %d, want 7", id)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyAfterRotation(t *testing.T) {
+	old, oldPub := newEdDSAKey(t, "2020-01")
+	before := newIssuer(t, testAudience, "2020-01", old)
+	oldToken, _, err := before.Issue(7, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The old key is kept around as verify only until its last
+	// token expires.
+	retired, err := NewPublicKey("2020-01", AlgEdDSA, oldPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, _ := newEdDSAKey(t, "2020-02")
+	after := newIssuer(t, testAudience, "2020-02", next, retired)
+	newToken, _, err := after.Issue(7, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tok := range map[string]string{"old": oldToken, "new": newToken} {
+		if _, err := after.Verify(tok); err != nil {
+			t.Errorf("%s token: Verify() err = %v, want nil", name, err)
+		}
+	}
+	parsed, _ := jwt.Parse(newToken, nil)
+	if kid := parsed.Header["kid"]; kid != "2020-02" {
+		t.Errorf("new token kid = %v, want 2020-02", kid)
+	}
+	if _, err := NewIssuer(testIssuer, testAudience, "2020-01", retired); err != ErrNoKeys {
+		t.Errorf("NewIssuer with verify only active key err = %v, want ErrNoKeys", err)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	ed, _ := newEdDSAKey(t, "b-ed")
+	rs := newRSAKey(t, "a-rsa")
+	hmac := NewHMACKey("c-hmac", []byte("0123456789abcdef0123456789abcdef"))
+	issuer := newIssuer(t, testAudience, "c-hmac", ed, rs, hmac)
+
+	set := issuer.JWKS()
+	want := []struct{ kid, kty, alg string }{
+		{"a-rsa", "RSA", AlgRS256},
+		{"b-ed", "OKP", AlgEdDSA},
+	}
+	if len(set.Keys) != len(want) {
+		t.Fatalf("JWKS() has %d keys, want %d: %+v", len(set.Keys), len(want), set.Keys)
+	}
+	for i, w := range want {
+		k := set.Keys[i]
+		if k.KeyID != w.kid || k.KeyType != w.kty || k.Algorithm != w.alg {
+			t.Errorf("key %d = %+v, want kid %s kty %s alg %s", i, k, w.kid, w.kty, w.alg)
+		}
+	}
+	if _, ok := hmac.JWK(); ok {
+		t.Error("HMAC key JWK() ok = true, want false")
+	}
+}
@@ -0,0 +1,150 @@
+package token
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// Key is a signing key identified by the kid header of the
+// tokens it signs. A Key built from a public key alone can only
+// verify, which is how retired asymmetric keys are kept around
+// until the last token they signed has expired.
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+
+	sign   interface{}
+	verify interface{}
+}
+
+// NewHMACKey returns an HS256 key. The same secret signs and
+// verifies, so it must never leave this service.
+func NewHMACKey(id string, secret []byte) *Key {
+	return &Key{
+		ID:     id,
+		Method: jwt.SigningMethodHS256,
+		sign:   secret,
+		verify: secret,
+	}
+}
+
+// NewRSAKey returns an RS256 key from a PEM encoded private key.
+func NewRSAKey(id string, privatePEM []byte) (*Key, error) {
+	priv, err := jwt.ParseRSAPrivateKeyFromPEM(privatePEM)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{
+		ID:     id,
+		Method: jwt.SigningMethodRS256,
+		sign:   priv,
+		verify: &priv.PublicKey,
+	}, nil
+}
+
+// NewEdDSAKey returns an EdDSA key from a PEM encoded PKCS #8
+// Ed25519 private key, as written by
+// `openssl genpkey -algorithm ed25519`.
+func NewEdDSAKey(id string, privatePEM []byte) (*Key, error) {
+	block, _ := pem.Decode(privatePEM)
+	if block == nil {
+		return nil, ErrKeyType
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, ErrKeyType
+	}
+	return &Key{
+		ID:     id,
+		Method: SigningMethodEdDSA,
+		sign:   priv,
+		verify: priv.Public(),
+	}, nil
+}
+
+// NewPublicKey returns a verify only key for alg, which must be
+// RS256 or EdDSA, from a PEM encoded PKIX public key.
+func NewPublicKey(id, alg string, publicPEM []byte) (*Key, error) {
+	block, _ := pem.Decode(publicPEM)
+	if block == nil {
+		return nil, ErrKeyType
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key := &Key{ID: id}
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		key.Method = jwt.SigningMethodRS256
+		key.verify = k
+	case ed25519.PublicKey:
+		key.Method = SigningMethodEdDSA
+		key.verify = k
+	default:
+		return nil, ErrKeyType
+	}
+	if key.Method.Alg() != alg {
+		return nil, ErrKeyType
+	}
+	return key, nil
+}
+
+// CanSign reports whether the key holds a private key or secret.
+func (k *Key) CanSign() bool {
+	return k.sign != nil
+}
+
+// JWK is the JSON Web Key (RFC 7517) form of a public key.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// OKP (Ed25519)
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWK returns the public half of the key. Symmetric keys have
+// no public half, so ok is false for them.
+func (k *Key) JWK() (jwk JWK, ok bool) {
+	jwk = JWK{
+		KeyID:     k.ID,
+		Use:       "sig",
+		Algorithm: k.Method.Alg(),
+	}
+	enc := base64.RawURLEncoding
+	switch pub := k.verify.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = enc.EncodeToString(pub.N.Bytes())
+		jwk.E = enc.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = enc.EncodeToString(pub)
+	default:
+		return jwk, false
+	}
+	return jwk, true
+}
@@ -0,0 +1,117 @@
+package views
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sockets/context"
+	"sockets/models"
+)
+
+// PublicError is implemented by errors whose message is safe
+// to show to the user, such as the models package's errors.
+type PublicError interface {
+	error
+	Public() string
+}
+
+// ErrorBody is the JSON body of every error response:
+//
+//	{"error": {"code": "not_found", "message": "Resource not found"}}
+//
+// RequestID is only set on 500s so that a user can quote it
+// and we can find the matching log line.
+type ErrorBody struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// statusFor maps public model errors that are not plain bad
+// input onto a more specific status code.
+var statusFor = map[error]int{
+	models.ErrNotFound:                 http.StatusNotFound,
+	models.ErrFriendUserNotFound:       http.StatusNotFound,
+	models.ErrPasswordIncorrect:        http.StatusUnauthorized,
+	models.ErrTokenInvalid:             http.StatusUnauthorized,
+	models.ErrTokenExpired:             http.StatusUnauthorized,
+	models.ErrTokenReused:              http.StatusUnauthorized,
+	models.ErrFriendNotAddressee:       http.StatusForbidden,
+	models.ErrNotFriends:               http.StatusForbidden,
+	models.ErrMessageNotSender:         http.StatusForbidden,
+	models.ErrMessageEditWindow:        http.StatusForbidden,
+	models.ErrConversationNotFriends:   http.StatusForbidden,
+	models.ErrConversationForbidden:    http.StatusForbidden,
+	models.ErrConversationOwnerRole:    http.StatusForbidden,
+	models.ErrEmailTaken:               http.StatusConflict,
+	models.ErrHandleTaken:              http.StatusConflict,
+	models.ErrFriendRequestExists:      http.StatusConflict,
+	models.ErrFriendNotPending:         http.StatusConflict,
+	models.ErrUserBlocked:              http.StatusConflict,
+	models.ErrConversationMemberExists: http.StatusConflict,
+	models.ErrReactionExists:           http.StatusConflict,
+	models.ErrConversationOwnerLeaving: http.StatusConflict,
+}
+
+// codes gives every status we send a short machine readable
+// code for clients to switch on.
+var codes = map[int]string{
+	http.StatusBadRequest:          "bad_request",
+	http.StatusUnauthorized:        "unauthorized",
+	http.StatusForbidden:           "forbidden",
+	http.StatusNotFound:            "not_found",
+	http.StatusMethodNotAllowed:    "method_not_allowed",
+	http.StatusConflict:            "conflict",
+	http.StatusTooManyRequests:     "too_many_requests",
+	http.StatusInternalServerError: "internal",
+	http.StatusServiceUnavailable:  "unavailable",
+}
+
+// RenderJSON encodes v as the response body with the given
+// status code.
+func RenderJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("views: encode response:", err)
+	}
+}
+
+// RenderError writes err as a JSON error response. Errors with
+// a public message are shown to the user with a 4xx status.
+// Anything else is logged alongside the request ID and the user
+// only gets a generic 500.
+func RenderError(w http.ResponseWriter, r *http.Request, err error) {
+	if pErr, ok := err.(PublicError); ok {
+		status, ok := statusFor[err]
+		if !ok {
+			status = http.StatusBadRequest
+		}
+		RenderStatus(w, r, status, pErr.Public())
+		return
+	}
+	log.Printf("[%s] %s %s: %v\n", context.RequestID(r.Context()), r.Method, r.URL.Path, err)
+	RenderStatus(w, r, http.StatusInternalServerError,
+		"Something went wrong. If the problem persists, please contact us.")
+}
+
+// RenderStatus writes a JSON error response with the given
+// status and message.
+func RenderStatus(w http.ResponseWriter, r *http.Request, status int, message string) {
+	code, ok := codes[status]
+	if !ok {
+		code = "error"
+	}
+	detail := ErrorDetail{
+		Code:    code,
+		Message: message,
+	}
+	if status >= http.StatusInternalServerError {
+		detail.RequestID = context.RequestID(r.Context())
+	}
+	RenderJSON(w, status, ErrorBody{Error: detail})
+}